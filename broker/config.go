@@ -0,0 +1,512 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	jsonpb "github.com/golang/protobuf/jsonpb"
+	proto "github.com/golang/protobuf/proto"
+	emulators "google/emulators"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// The package of the generated messages, whose nested messages are overlaid
+// field by field.
+var emulatorsPkgPath = reflect.TypeOf(emulators.Emulator{}).PkgPath()
+
+// The parsers of the config file formats, by format.
+var configParsers = map[string]func(data []byte, config *emulators.BrokerConfig) (*configFields, error){
+	"json": parseJsonConfig,
+	"yaml": parseYamlConfig,
+	"text": parseTextConfig,
+}
+
+// The formats of config files, by file extension.
+var configFormatsByExt = map[string]string{
+	".json":      "json",
+	".yaml":      "yaml",
+	".yml":       "yaml",
+	".textproto": "text",
+	".pbtxt":     "text",
+}
+
+// LoadConfig reads the config files, and layers them into a single config.
+// Each path may be a glob pattern, matching files in lexical order. Later
+// files overlay earlier ones: an emulator with the same emulator_id as an
+// earlier one overrides the fields present in the file, even those set to
+// their default value, e.g. false, while rules, groups and port ranges must
+// not conflict with earlier ones. In the text format, which doesn't tell
+// default values from missing ones, only the fields that are set override.
+// The files listed in the includes of a file are loaded before the file
+// itself, and each file is loaded at most once.
+//
+// The format of each file, "json", "yaml" or "text" (the protobuf text
+// format), is chosen by its extension. Files with other extensions are in
+// the given format.
+func LoadConfig(format string, paths ...string) (*emulators.BrokerConfig, error) {
+	if _, exists := configParsers[format]; !exists {
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	l := newConfigLoader(format)
+	for _, pattern := range paths {
+		files, err := globConfigFiles(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := l.load(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return l.config, nil
+}
+
+// Returns the files matching the pattern, in lexical order. Returns an error
+// if no file matches.
+func globConfigFiles(pattern string) ([]string, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file pattern %q: %v", pattern, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config file matches %q", pattern)
+	}
+	return files, nil
+}
+
+// Reads a single config file, without its includes, in the format chosen by
+// its extension, or in the given format. Also returns the fields present in
+// the file.
+func readConfigFile(path string, format string) (*emulators.BrokerConfig, *configFields, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if f, exists := configFormatsByExt[strings.ToLower(filepath.Ext(path))]; exists {
+		format = f
+	}
+	config := &emulators.BrokerConfig{}
+	present, err := configParsers[format](data, config)
+	if _, positioned := err.(*configError); positioned {
+		return nil, nil, fmt.Errorf("failed to parse config file %s:%v", path, err)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return config, present, nil
+}
+
+// configFields are the fields present in a config file for a message, by the
+// names of the generated struct fields. The fields of nested messages of this
+// package are present in their values, and those of repeated messages in the
+// items, in order.
+type configFields struct {
+	fields map[string]*configFields
+	items  []*configFields
+}
+
+// Returns the fields present in the ith item of a repeated message.
+func (c *configFields) item(i int) *configFields {
+	if c == nil || i >= len(c.items) {
+		return &configFields{}
+	}
+	return c.items[i]
+}
+
+// configError is an error at a position of a config file.
+type configError struct {
+	line   int
+	column int
+	msg    string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.line, e.column, e.msg)
+}
+
+// Returns an error at the byte offset of data.
+func configErrorAt(data []byte, offset int, msg string) *configError {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := offset - bytes.LastIndex(data[:offset], []byte("\n"))
+	return &configError{line: line, column: column, msg: msg}
+}
+
+// Returns an error at the position of the YAML node.
+func configErrorAtNode(node *yaml.Node, format string, a ...interface{}) *configError {
+	return &configError{line: node.Line, column: node.Column, msg: fmt.Sprintf(format, a...)}
+}
+
+func parseJsonConfig(data []byte, config *emulators.BrokerConfig) (*configFields, error) {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		// The offset is right after the unexpected character.
+		return nil, configErrorAt(data, int(syntaxErr.Offset)-1, syntaxErr.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, so the fields can be checked with their positions.
+	var node yaml.Node
+	if yaml.Unmarshal(data, &node) == nil {
+		if err := checkConfigFields(&node, reflect.TypeOf(config).Elem()); err != nil {
+			return nil, err
+		}
+	}
+	err = jsonpb.Unmarshal(bytes.NewReader(data), config)
+	if err != nil {
+		return nil, err
+	}
+	return jsonFields(v, reflect.TypeOf(config)), nil
+}
+
+func parseYamlConfig(data []byte, config *emulators.BrokerConfig) (*configFields, error) {
+	var node yaml.Node
+	err := yaml.Unmarshal(data, &node)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfigFields(&node, reflect.TypeOf(config).Elem()); err != nil {
+		return nil, err
+	}
+	// Convert the YAML to JSON, whose mapping to protobuf messages is well
+	// defined, e.g. for durations.
+	var v interface{}
+	err = node.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		// An empty file.
+		return &configFields{}, nil
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	err = jsonpb.Unmarshal(bytes.NewReader(data), config)
+	if err != nil {
+		return nil, err
+	}
+	return jsonFields(v, reflect.TypeOf(config)), nil
+}
+
+func parseTextConfig(data []byte, config *emulators.BrokerConfig) (*configFields, error) {
+	err := proto.UnmarshalText(string(data), config)
+	if parseErr, ok := err.(*proto.ParseError); ok {
+		return nil, configErrorAt(data, parseErr.Offset, parseErr.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The text format is parsed into the message alone, so the fields that
+	// are present are those that are set, as marshaled to JSON.
+	m := jsonpb.Marshaler{OrigName: true}
+	s, err := m.MarshalToString(config)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return jsonFields(v, reflect.TypeOf(config)), nil
+}
+
+// Returns the fields present in the decoded JSON value v of a field of type
+// t. Null values are not present.
+func jsonFields(v interface{}, t reflect.Type) *configFields {
+	present := &configFields{}
+	switch {
+	case t.Kind() == reflect.Slice && isConfigMessage(t.Elem()):
+		items, _ := v.([]interface{})
+		for _, item := range items {
+			present.items = append(present.items, jsonFields(item, t.Elem()))
+		}
+	case isConfigMessage(t):
+		m, _ := v.(map[string]interface{})
+		fields, _ := messageFields(t.Elem())
+		present.fields = make(map[string]*configFields)
+		for key, value := range m {
+			if f, exists := fields[key]; exists && value != nil {
+				present.fields[f.Name] = jsonFields(value, f.Type)
+			}
+		}
+	}
+	return present
+}
+
+// Checks that the keys of the mappings in the YAML node are fields of the
+// message type t, recursively, and that messages and repeated fields are
+// mappings and sequences, to report mistakes with their position.
+func checkConfigFields(node *yaml.Node, t reflect.Type) error {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		node = node.Content[0]
+	}
+	if node.Kind == 0 || node.Tag == "!!null" {
+		// Empty.
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return configErrorAtNode(node, "expected a mapping for %s", t.Name())
+	}
+	fields, hasOneof := messageFields(t)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		f, exists := fields[key.Value]
+		if !exists {
+			if hasOneof {
+				// Might be a field of the oneof, which is checked when parsing.
+				continue
+			}
+			return configErrorAtNode(key, "unknown field %q in %s", key.Value, t.Name())
+		}
+		if value.Tag == "!!null" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.Uint8 {
+			if value.Kind != yaml.SequenceNode {
+				return configErrorAtNode(value, "expected a list for field %q", key.Value)
+			}
+			if isConfigMessage(f.Type.Elem()) {
+				for _, item := range value.Content {
+					if err := checkConfigFields(item, f.Type.Elem().Elem()); err != nil {
+						return err
+					}
+				}
+			}
+		} else if isConfigMessage(f.Type) {
+			if err := checkConfigFields(value, f.Type.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Whether t is a pointer to a message of this package. Other messages, e.g.
+// durations, have their own representation.
+func isConfigMessage(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct && t.Elem().PkgPath() == emulatorsPkgPath
+}
+
+// Returns the fields of the generated message type t, by their original and
+// JSON names, and whether t has a oneof.
+func messageFields(t reflect.Type) (map[string]reflect.StructField, bool) {
+	fields := make(map[string]reflect.StructField)
+	hasOneof := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("protobuf_oneof") != "" {
+			hasOneof = true
+			continue
+		}
+		for _, option := range strings.Split(f.Tag.Get("protobuf"), ",") {
+			if strings.HasPrefix(option, "name=") || strings.HasPrefix(option, "json=") {
+				fields[option[5:]] = f
+			}
+		}
+	}
+	return fields, hasOneof
+}
+
+// configLoader layers config files into a single config, and remembers which
+// file defined what, to report conflicts.
+type configLoader struct {
+	config *emulators.BrokerConfig
+	// The format of files whose extension doesn't determine it.
+	format string
+	// The layered emulators, rules and groups, by id.
+	emulators map[string]*emulators.Emulator
+	rules     map[string]*emulators.ResolveRule
+	groups    map[string]*emulators.EmulatorGroup
+	// The files that defined the emulators, rules and groups, by kind and id,
+	// e.g. "rule foo", and the files that defined the port ranges, in order.
+	origins          map[string]string
+	portRangeOrigins []string
+	// The files being loaded, from the first one to the innermost include.
+	stack  []string
+	loaded map[string]bool
+}
+
+func newConfigLoader(format string) *configLoader {
+	return &configLoader{
+		config:    &emulators.BrokerConfig{},
+		format:    format,
+		emulators: make(map[string]*emulators.Emulator),
+		rules:     make(map[string]*emulators.ResolveRule),
+		groups:    make(map[string]*emulators.EmulatorGroup),
+		origins:   make(map[string]string),
+		loaded:    make(map[string]bool)}
+}
+
+// Loads the includes of the file, and then layers the file on top of them.
+func (l *configLoader) load(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range l.stack {
+		if p == path {
+			return fmt.Errorf("config files include each other: %s", strings.Join(append(l.stack, path), " -> "))
+		}
+	}
+	if l.loaded[path] {
+		return nil
+	}
+	config, present, err := readConfigFile(path, l.format)
+	if err != nil {
+		return err
+	}
+	l.stack = append(l.stack, path)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+	for _, include := range config.Includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		files, err := globConfigFiles(include)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, file := range files {
+			if err := l.load(file); err != nil {
+				return err
+			}
+		}
+	}
+	l.loaded[path] = true
+	return l.merge(path, config, present)
+}
+
+// Layers the config of the file, with the given fields present, on top of the
+// configs loaded before.
+func (l *configLoader) merge(path string, config *emulators.BrokerConfig, present *configFields) error {
+	for _, r := range config.PortRanges {
+		duplicate := false
+		for i, other := range l.config.PortRanges {
+			if proto.Equal(r, other) {
+				duplicate = true
+				break
+			}
+			if r.Begin < other.End && other.Begin < r.End {
+				return fmt.Errorf("%s: port range [%d, %d) overlaps port range [%d, %d) of %s",
+					path, r.Begin, r.End, other.Begin, other.End, l.portRangeOrigins[i])
+			}
+		}
+		if !duplicate {
+			l.config.PortRanges = append(l.config.PortRanges, r)
+			l.portRangeOrigins = append(l.portRangeOrigins, path)
+		}
+	}
+	for i, e := range config.Emulators {
+		id := e.EmulatorId
+		if emu, exists := l.emulators[id]; exists {
+			if l.origins["emulator "+id] == path {
+				return fmt.Errorf("%s: emulator %q is defined more than once", path, id)
+			}
+			emulatorFields := present.fields["Emulators"].item(i)
+			overlayFields(reflect.ValueOf(emu).Elem(), reflect.ValueOf(e).Elem(), emulatorFields)
+		} else {
+			l.config.Emulators = append(l.config.Emulators, e)
+			if id != "" {
+				l.emulators[id] = e
+			}
+		}
+		l.origins["emulator "+id] = path
+	}
+	for _, r := range config.Rules {
+		id := r.RuleId
+		if rule, exists := l.rules[id]; exists {
+			if !proto.Equal(r, rule) {
+				return fmt.Errorf("%s: rule %q conflicts with the rule defined in %s", path, id, l.origins["rule "+id])
+			}
+			continue
+		}
+		l.config.Rules = append(l.config.Rules, r)
+		if id != "" {
+			l.rules[id] = r
+			l.origins["rule "+id] = path
+		}
+	}
+	for _, g := range config.Groups {
+		id := g.GroupId
+		if group, exists := l.groups[id]; exists {
+			if !proto.Equal(g, group) {
+				return fmt.Errorf("%s: group %q conflicts with the group defined in %s", path, id, l.origins["group "+id])
+			}
+			continue
+		}
+		l.config.Groups = append(l.config.Groups, g)
+		if id != "" {
+			l.groups[id] = g
+			l.origins["group "+id] = path
+		}
+	}
+	// The remaining fields are settings, overridden by the file if it sets
+	// them.
+	settings := &configFields{fields: make(map[string]*configFields)}
+	for name, f := range present.fields {
+		switch name {
+		case "PortRanges", "Emulators", "Rules", "Groups", "Includes":
+		default:
+			settings.fields[name] = f
+		}
+	}
+	overlayFields(reflect.ValueOf(l.config).Elem(), reflect.ValueOf(config).Elem(), settings)
+	return nil
+}
+
+// Overrides the fields of the dst message with the fields of the src message
+// that are present in its config file, even if they have their default value.
+// Nested messages of this package are overlaid field by field, while other
+// fields, including repeated fields, maps and durations, are replaced.
+func overlayFields(dst reflect.Value, src reflect.Value, present *configFields) {
+	for name, fieldPresent := range present.fields {
+		s, d := src.FieldByName(name), dst.FieldByName(name)
+		if isConfigMessage(s.Type()) && !s.IsNil() && !d.IsNil() {
+			overlayFields(d.Elem(), s.Elem(), fieldPresent)
+		} else {
+			d.Set(s)
+		}
+	}
+	// The fields of a oneof are not known by name, and replace the oneof if
+	// one of them is set.
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).Tag.Get("protobuf_oneof") != "" && !src.Field(i).IsNil() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
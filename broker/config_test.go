@@ -0,0 +1,428 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpb "github.com/golang/protobuf/jsonpb"
+	proto "github.com/golang/protobuf/proto"
+	emulators "google/emulators"
+)
+
+// Writes the content to a file in dir, and returns its path.
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes the config as a JSON file in dir, and returns its path.
+func writeConfigFile(t *testing.T, dir string, name string, config *emulators.BrokerConfig) string {
+	m := jsonpb.Marshaler{OrigName: true}
+	s, err := m.MarshalToString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, dir, name, s)
+}
+
+func TestLoadConfig_WithOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := writeConfigFile(t, dir, "base.json", &emulators.BrokerConfig{
+		PortRanges:       []*emulators.PortRange{{Begin: 10000, End: 10100}},
+		Emulators:        []*emulators.Emulator{dummyEmulator},
+		Rules:            []*emulators.ResolveRule{{RuleId: "r1", TargetPatterns: []string{"r1_service"}}},
+		EmulatorLogLines: 100,
+	})
+	overlay := writeConfigFile(t, dir, "overlay.json", &emulators.BrokerConfig{
+		PortRanges: []*emulators.PortRange{{Begin: 10100, End: 10200}},
+		Emulators: []*emulators.Emulator{
+			{
+				EmulatorId:    "dummy",
+				StartCommand:  &emulators.CommandLine{Args: []string{"--verbose"}},
+				StartOnDemand: true,
+			},
+		},
+		// Identical to the base rule.
+		Rules:            []*emulators.ResolveRule{{RuleId: "r1", TargetPatterns: []string{"r1_service"}}},
+		EmulatorLogLines: 200,
+	})
+
+	config, err := LoadConfig("json", base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	want.StartCommand.Args = []string{"--verbose"}
+	want.StartOnDemand = true
+	if len(config.Emulators) != 1 || !proto.Equal(config.Emulators[0], want) {
+		t.Errorf("Expected %v: %v", want, config.Emulators)
+	}
+	if len(config.Rules) != 1 {
+		t.Errorf("Expected 1 rule: %v", config.Rules)
+	}
+	if len(config.PortRanges) != 2 {
+		t.Errorf("Expected 2 port ranges: %v", config.PortRanges)
+	}
+	if config.EmulatorLogLines != 200 {
+		t.Errorf("Expected 200: %d", config.EmulatorLogLines)
+	}
+}
+
+func TestLoadConfig_WithOverlayOfDefaultValues(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := writeFile(t, dir, "base.yaml", `
+reject_ambiguous_matches: true
+emulator_log_dir: /tmp/logs
+emulator_log_lines: 100
+emulators:
+  - emulator_id: dummy
+    start_on_demand: true
+    start_command: {path: /exepath, args: [arg1]}
+    rule: {rule_id: dummy_rule, resolved_host: "localhost:1234"}
+`)
+	// The overlays set fields back to their default values, and leave others
+	// as they are.
+	overlays := []string{
+		writeFile(t, dir, "overlay.yaml", `
+reject_ambiguous_matches: false
+emulator_log_dir: ""
+emulators:
+  - emulator_id: dummy
+    start_on_demand: false
+    rule: {resolved_host: ""}
+`),
+		writeFile(t, dir, "overlay.json", `{
+  "rejectAmbiguousMatches": false,
+  "emulator_log_dir": "",
+  "emulators": [{"emulator_id": "dummy", "start_on_demand": false, "rule": {"resolved_host": ""}}]
+}`),
+	}
+	for _, overlay := range overlays {
+		config, err := LoadConfig("json", base, overlay)
+		if err != nil {
+			t.Errorf("%s: %v", overlay, err)
+			continue
+		}
+		if config.RejectAmbiguousMatches || config.EmulatorLogDir != "" || config.EmulatorLogLines != 100 {
+			t.Errorf("%s: expected the settings to be overlaid: %v", overlay, config)
+		}
+		want := &emulators.Emulator{
+			EmulatorId:   "dummy",
+			StartCommand: &emulators.CommandLine{Path: "/exepath", Args: []string{"arg1"}},
+			Rule:         &emulators.ResolveRule{RuleId: "dummy_rule"},
+		}
+		if len(config.Emulators) != 1 || !proto.Equal(config.Emulators[0], want) {
+			t.Errorf("%s: expected %v: %v", overlay, want, config.Emulators)
+		}
+	}
+
+	// The text format doesn't tell default values from missing ones, so they
+	// don't override.
+	overlay := writeFile(t, dir, "overlay.pbtxt", `
+reject_ambiguous_matches: false
+emulator_log_lines: 200
+emulators { emulator_id: "dummy" start_on_demand: false }
+`)
+	config, err := LoadConfig("json", base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.RejectAmbiguousMatches || config.EmulatorLogLines != 200 {
+		t.Errorf("Expected only the settings that are set to be overlaid: %v", config)
+	}
+	if len(config.Emulators) != 1 || !config.Emulators[0].StartOnDemand {
+		t.Errorf("Expected the emulator to start on demand: %v", config.Emulators)
+	}
+}
+
+func TestLoadConfig_WithIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFile(t, dir, "base.json", &emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{dummyEmulator},
+	})
+	// Both teams build on the base, which is only loaded once.
+	writeConfigFile(t, dir, "teams/a.json", &emulators.BrokerConfig{
+		Includes: []string{"../base.json"},
+		Rules:    []*emulators.ResolveRule{{RuleId: "a", TargetPatterns: []string{"a_service"}}},
+	})
+	writeConfigFile(t, dir, "teams/b.json", &emulators.BrokerConfig{
+		Includes: []string{"../base.json"},
+		Rules:    []*emulators.ResolveRule{{RuleId: "b", TargetPatterns: []string{"b_service"}}},
+	})
+	root := writeConfigFile(t, dir, "main.json", &emulators.BrokerConfig{
+		Includes: []string{"teams/*.json"},
+		Emulators: []*emulators.Emulator{
+			{EmulatorId: "dummy", StopSignal: "SIGINT"},
+		},
+	})
+
+	config, err := LoadConfig("json", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Emulators) != 1 || config.Emulators[0].StopSignal != "SIGINT" {
+		t.Errorf("Expected the dummy emulator with a stop signal: %v", config.Emulators)
+	}
+	var ruleIds []string
+	for _, r := range config.Rules {
+		ruleIds = append(ruleIds, r.RuleId)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ruleIds, want) {
+		t.Errorf("Expected %v: %v", want, ruleIds)
+	}
+	if len(config.Includes) != 0 {
+		t.Errorf("Expected no includes: %v", config.Includes)
+	}
+
+	// Overlay files can be globs too.
+	config, err = LoadConfig("json", filepath.Join(dir, "teams", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Emulators) != 1 || len(config.Rules) != 2 {
+		t.Errorf("Expected 1 emulator and 2 rules: %v", config)
+	}
+}
+
+func TestLoadConfig_WhenInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := writeConfigFile(t, dir, "base.json", &emulators.BrokerConfig{
+		PortRanges: []*emulators.PortRange{{Begin: 10000, End: 10100}},
+		Rules:      []*emulators.ResolveRule{{RuleId: "r1", TargetPatterns: []string{"r1_service"}}},
+	})
+	conflictingRule := writeConfigFile(t, dir, "rule.json", &emulators.BrokerConfig{
+		Rules: []*emulators.ResolveRule{{RuleId: "r1", TargetPatterns: []string{"other_service"}}},
+	})
+	overlappingPorts := writeConfigFile(t, dir, "ports.json", &emulators.BrokerConfig{
+		PortRanges: []*emulators.PortRange{{Begin: 10050, End: 10150}},
+	})
+	duplicateEmulator := writeConfigFile(t, dir, "duplicate.json", &emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{dummyEmulator, dummyEmulator},
+	})
+	cycle := writeConfigFile(t, dir, "cycle.json", &emulators.BrokerConfig{
+		Includes: []string{"cycle.json"},
+	})
+	missingInclude := writeConfigFile(t, dir, "missing.json", &emulators.BrokerConfig{
+		Includes: []string{"nothing/*.json"},
+	})
+
+	cases := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{base, conflictingRule}, `rule "r1" conflicts with the rule defined in ` + base},
+		{[]string{base, overlappingPorts}, "port range [10050, 10150) overlaps port range [10000, 10100) of " + base},
+		{[]string{duplicateEmulator}, `emulator "dummy" is defined more than once`},
+		{[]string{cycle}, "config files include each other: " + cycle + " -> " + cycle},
+		{[]string{missingInclude}, "no config file matches"},
+		{[]string{filepath.Join(dir, "*.yaml")}, "no config file matches"},
+	}
+	for _, c := range cases {
+		_, err := LoadConfig("json", c.paths...)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("LoadConfig(%v): expected %q: %v", c.paths, c.want, err)
+		}
+	}
+}
+
+func TestLoadConfig_WithFormats(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	yaml := `
+# The dummy emulator.
+emulators:
+  - emulator_id: dummy
+    start_command:
+      path: /exepath
+      args: [arg1, arg2]
+    rule:
+      rule_id: dummy_rule
+      target_patterns: [pattern1, pattern2]
+`
+	text := `
+# The dummy emulator.
+emulators {
+  emulator_id: "dummy"
+  start_command { path: "/exepath" args: "arg1" args: "arg2" }
+  rule { rule_id: "dummy_rule" target_patterns: "pattern1" target_patterns: "pattern2" }
+}
+`
+	cases := []struct {
+		path   string
+		format string
+	}{
+		{writeFile(t, dir, "dummy.yaml", yaml), "json"},
+		{writeFile(t, dir, "dummy.yml", yaml), "json"},
+		{writeFile(t, dir, "dummy.pbtxt", text), "json"},
+		{writeFile(t, dir, "dummy.textproto", text), "json"},
+		// The format is not determined by the extension.
+		{writeFile(t, dir, "dummy.conf", yaml), "yaml"},
+		{writeFile(t, dir, "dummy.cfg", text), "text"},
+	}
+	for _, c := range cases {
+		config, err := LoadConfig(c.format, c.path)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if len(config.Emulators) != 1 || !proto.Equal(config.Emulators[0], dummyEmulator) {
+			t.Errorf("%s: expected %v: %v", c.path, dummyEmulator, config.Emulators)
+		}
+	}
+	_, err = LoadConfig("xml", cases[0].path)
+	if err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+}
+
+func TestLoadConfig_WithParseErrors(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"field.yaml", "emulators:\n  - emulator_id: dummy\n    start_comand:\n      path: /exepath\n",
+			`field.yaml:3:5: unknown field "start_comand" in Emulator`},
+		{"list.json", "{\n  \"emulators\": {}\n}",
+			`list.json:2:16: expected a list for field "emulators"`},
+		{"syntax.json", "{\n  \"emulators\": [,]\n}",
+			"syntax.json:2:17: invalid character ','"},
+		{"field.pbtxt", "emulators {\n  emulator_idd: \"dummy\"\n}\n",
+			"field.pbtxt:2:"},
+	}
+	for _, c := range cases {
+		path := writeFile(t, dir, c.name, c.content)
+		_, err := LoadConfig("json", path)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected %q: %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(tmpDir, "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := writeFile(t, dir, "emulator.sh", "#!/bin/sh\n")
+	if err := os.Chmod(exe, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := &emulators.BrokerConfig{
+		PortRanges: []*emulators.PortRange{{Begin: 10000, End: 10100}, {Begin: 10050, End: 10150}},
+		Emulators: []*emulators.Emulator{
+			{
+				EmulatorId: "missing",
+				StartCommand: &emulators.CommandLine{
+					Path: "{dir:broker}/missing",
+					Args: []string{"--port={port:}", "--user={env:BROKER_VALIDATE_UNSET}"},
+				},
+				Rule:      &emulators.ResolveRule{RuleId: "missing_rule", TargetPatterns: []string{"service"}},
+				DependsOn: []string{"good"},
+			},
+			{
+				EmulatorId:   "good",
+				StartCommand: &emulators.CommandLine{Path: exe, Args: []string{"--port={port:main}"}},
+				Rule: &emulators.ResolveRule{
+					RuleId:         "good_rule",
+					TargetPatterns: []string{"serv.ce"},
+					ResolvedHost:   "localhost:{port:main}",
+				},
+				ReadinessCheck: &emulators.ReadinessCheck{
+					Probe: &emulators.Probe{Check: &emulators.Probe_TcpConnect{&emulators.TcpConnectProbe{}}},
+				},
+			},
+			{
+				EmulatorId: "no_command",
+				Rule:       &emulators.ResolveRule{RuleId: "no_command_rule"},
+			},
+			{
+				// All of its problems are reported.
+				EmulatorId:   "bad id",
+				StartCommand: &emulators.CommandLine{Path: dir + "/absent", Args: []string{"--port={port:"}},
+				Rule:         &emulators.ResolveRule{RuleId: "bad_id_rule"},
+				StopSignal:   "SIGFOO",
+			},
+		},
+		Rules:  []*emulators.ResolveRule{{RuleId: "bad_regex", TargetPatterns: []string{"("}}},
+		Groups: []*emulators.EmulatorGroup{{GroupId: "all", EmulatorIds: []string{"good", "ghost"}}},
+	}
+
+	expanded, problems, warnings := ValidateConfig(config, dir)
+	want := []string{
+		"Overlapping PortRange",
+		"emulator.start_command was not specified",
+		"emulator.emulator_id contains invalid characters",
+		`Emulator "bad id": stop_signal invalid`,
+		`Emulator "bad id": malformed token "{port:"`,
+		`Emulator "bad id": start_command.path is not an executable file`,
+		`Resolve rule "bad_regex": target_patterns invalid`,
+		`Emulator "missing": malformed token "{port:}"`,
+		`Group "all": emulator "ghost" doesn't exist`,
+		`matches rules ["good_rule" "missing_rule"] equally well`,
+		`Emulator "missing": start_command.path is not an executable file`,
+	}
+	all := strings.Join(problems, "\n")
+	for _, w := range want {
+		if !strings.Contains(all, w) {
+			t.Errorf("Expected a problem containing %q: %s", w, all)
+		}
+	}
+	if len(problems) != len(want) {
+		t.Errorf("Expected %d problems: %s", len(want), all)
+	}
+	// The broker expands unset environment variables to "".
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `Emulator "missing": environment variable "BROKER_VALIDATE_UNSET" is not set`) {
+		t.Errorf("Expected a warning about the unset environment variable: %v", warnings)
+	}
+
+	// In the order they would start, with the tokens expanded.
+	if len(expanded) != 2 || expanded[0].EmulatorId != "good" || expanded[1].EmulatorId != "missing" {
+		t.Fatalf("Expected the good and missing emulators: %v", expanded)
+	}
+	good := expanded[0]
+	port := good.Ports["main"]
+	if want := fmt.Sprintf("--port=%d", port); port == 0 || good.StartCommand.Args[0] != want {
+		t.Errorf("Expected %q: %v", want, good.StartCommand.Args)
+	}
+	if want := fmt.Sprintf("localhost:%d", port); good.Rule.ResolvedHost != want {
+		t.Errorf("Expected %q: %q", want, good.Rule.ResolvedHost)
+	}
+	if want := dir + "/missing"; expanded[1].StartCommand.Path != want {
+		t.Errorf("Expected %q: %q", want, expanded[1].StartCommand.Path)
+	}
+	if !proto.Equal(config.Emulators[1].StartCommand, &emulators.CommandLine{Path: exe, Args: []string{"--port={port:main}"}}) {
+		t.Errorf("Expected the config to be left alone: %v", config.Emulators[1])
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"sort"
+
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	emulators "google/emulators"
+)
+
+// Checks whether the dependencies of the emulator are valid, on their own.
+// Cycles are detected separately, since they depend on other emulators.
+func checkDependencies(emu *emulators.Emulator) error {
+	seen := make(map[string]bool)
+	for _, id := range emu.DependsOn {
+		if !idMatcher.MatchString(id) {
+			return fmt.Errorf("invalid emulator_id: %q", id)
+		}
+		if id == emu.EmulatorId {
+			return fmt.Errorf("emulator depends on itself")
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate emulator_id: %q", id)
+		}
+		seen[id] = true
+	}
+	for _, id := range hostNames(emu.StartCommand) {
+		if !seen[id] {
+			return fmt.Errorf("start_command refers to the host of %q, which is not a dependency", id)
+		}
+	}
+	return nil
+}
+
+// Returns the chain of dependencies from an emulator with the given id and
+// dependencies back to itself, through the existing emulators, e.g.
+// ["a", "b", "a"], or nil if there is no such cycle.
+// REQUIRES s.mu.Lock().
+func (s *server) findDependencyCycle(id string, dependsOn []string) []string {
+	visited := make(map[string]bool)
+	var visit func(path []string, dependsOn []string) []string
+	visit = func(path []string, dependsOn []string) []string {
+		for _, dep := range dependsOn {
+			if dep == id {
+				return append(path, dep)
+			}
+			emu, exists := s.emulators[dep]
+			if !exists || visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if cycle := visit(append(path, dep), emu.emulator.DependsOn); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return visit([]string{id}, dependsOn)
+}
+
+// Returns the ids of the emulator and its transitive dependencies, in the
+// order they should be started: each emulator comes after its dependencies.
+// Returns NOT_FOUND if the emulator doesn't exist, and FAILED_PRECONDITION
+// if one of the dependencies doesn't exist.
+// REQUIRES s.mu.Lock().
+func (s *server) startOrder(id string) ([]string, error) {
+	emu, exists := s.emulators[id]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
+	}
+	var order []string
+	visited := make(map[string]bool)
+	var visit func(emu *localEmulator) error
+	visit = func(emu *localEmulator) error {
+		visited[emu.emulator.EmulatorId] = true
+		for _, dep := range emu.emulator.DependsOn {
+			if visited[dep] {
+				continue
+			}
+			depEmu, exists := s.emulators[dep]
+			if !exists {
+				return grpc.Errorf(codes.FailedPrecondition,
+					"Emulator %q depends on emulator %q, which doesn't exist.", emu.emulator.EmulatorId, dep)
+			}
+			if err := visit(depEmu); err != nil {
+				return err
+			}
+		}
+		order = append(order, emu.emulator.EmulatorId)
+		return nil
+	}
+	if err := visit(emu); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Returns the ids of the emulators that depend on the emulator directly,
+// whether they are running or not, sorted.
+// REQUIRES s.mu.Lock().
+func (s *server) directDependents(id string) []string {
+	var ids []string
+	for _, emu := range s.emulators {
+		for _, dep := range emu.emulator.DependsOn {
+			if dep == id {
+				ids = append(ids, emu.emulator.EmulatorId)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the ids of the running emulators that transitively depend on the
+// emulator, in the order they should be stopped: each emulator comes before
+// its dependencies.
+// REQUIRES s.mu.Lock().
+func (s *server) runningDependents(id string) []string {
+	dependents := make(map[string][]string)
+	for _, emu := range s.emulators {
+		for _, dep := range emu.emulator.DependsOn {
+			dependents[dep] = append(dependents[dep], emu.emulator.EmulatorId)
+		}
+	}
+	var order []string
+	visited := map[string]bool{id: true}
+	var visit func(id string)
+	visit = func(id string) {
+		ids := dependents[id]
+		sort.Strings(ids)
+		for _, dependent := range ids {
+			if visited[dependent] {
+				continue
+			}
+			visited[dependent] = true
+			visit(dependent)
+			if s.emulators[dependent].running() {
+				order = append(order, dependent)
+			}
+		}
+	}
+	visit(id)
+	return order
+}
+
+// Returns the resolved host of the emulator, for "{host:EMULATOR_ID}" tokens.
+// REQUIRES s.mu.Lock().
+func (s *server) emulatorHost(id string) (string, error) {
+	emu, exists := s.emulators[id]
+	if !exists {
+		return "", fmt.Errorf("emulator %q doesn't exist", id)
+	}
+	host := emu.emulator.Rule.ResolvedHost
+	if host == "" {
+		return "", fmt.Errorf("emulator %q has no resolved host (%s)", id, emu.State())
+	}
+	return host, nil
+}
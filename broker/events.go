@@ -0,0 +1,77 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	emulators "google/emulators"
+)
+
+// The maximum number of events queued for a watcher. A watcher that falls
+// further behind is overflowed, and its stream is closed.
+const maxWatcherEvents = 1000
+
+// emulatorWatcher queues the events of the emulators it watches, until they
+// are taken. Guarded by the server lock.
+type emulatorWatcher struct {
+	// The emulator being watched, or empty to watch all emulators.
+	emulatorId string
+	events     []*emulators.EmulatorEvent
+	// Whether events were dropped because the queue was full.
+	overflowed bool
+	// Receives a value when events are queued.
+	updated chan bool
+}
+
+func newEmulatorWatcher(emulatorId string) *emulatorWatcher {
+	return &emulatorWatcher{emulatorId: emulatorId, updated: make(chan bool, 1)}
+}
+
+// Queues the event, if it is about a watched emulator. Drops the event, and
+// marks the watcher as overflowed, if the queue is full. Never blocks.
+func (w *emulatorWatcher) deliver(event *emulators.EmulatorEvent) {
+	if w.emulatorId != "" && w.emulatorId != event.EmulatorId {
+		return
+	}
+	if len(w.events) >= maxWatcherEvents {
+		w.overflowed = true
+	} else {
+		w.events = append(w.events, event)
+	}
+	select {
+	case w.updated <- true:
+	default:
+	}
+}
+
+// Returns the queued events, and clears the queue. Also returns whether
+// events were dropped after them.
+func (w *emulatorWatcher) take() ([]*emulators.EmulatorEvent, bool) {
+	events := w.events
+	w.events = nil
+	return events, w.overflowed
+}
+
+// Delivers the event to the watchers, and wakes up goroutines waiting for
+// emulators to change.
+// REQUIRES s.mu.Lock().
+func (s *server) publishEvent(event *emulators.EmulatorEvent) {
+	for w := range s.watchers {
+		w.deliver(event)
+	}
+	close(s.changed)
+	s.changed = make(chan bool)
+}
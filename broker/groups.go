@@ -0,0 +1,261 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+
+	glog "github.com/golang/glog"
+	proto "github.com/golang/protobuf/proto"
+	pb "github.com/golang/protobuf/ptypes/empty"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	emulators "google/emulators"
+)
+
+// Checks whether the emulator ids of a group are valid.
+func checkGroupMembers(ids []string) error {
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if !idMatcher.MatchString(id) {
+			return fmt.Errorf("invalid emulator_id: %q", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate emulator_id: %q", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Checks whether the group is valid. Returns INVALID_ARGUMENT if it is not.
+func checkGroup(group *emulators.EmulatorGroup) error {
+	id := group.GroupId
+	if id == "" {
+		return grpc.Errorf(codes.InvalidArgument, "group.group_id was not specified")
+	}
+	if !idMatcher.MatchString(id) {
+		return grpc.Errorf(codes.InvalidArgument, "group.group_id contains invalid characters")
+	}
+	if err := checkGroupMembers(group.EmulatorIds); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Group %q: emulator_ids invalid: %v", id, err)
+	}
+	return nil
+}
+
+// Describes the outcome of starting or stopping a member of a group.
+func groupMemberResult(id string, err error) *emulators.GroupMemberResult {
+	result := &emulators.GroupMemberResult{EmulatorId: id, Code: grpc.Code(err).String()}
+	if err != nil {
+		result.Error = grpc.ErrorDesc(err)
+	}
+	return result
+}
+
+func (s *server) CreateGroup(ctx context.Context, req *emulators.EmulatorGroup) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "CreateGroup", req.GroupId, &err)
+	glog.V(1).Infof("CreateGroup %v.", req)
+	if err := checkGroup(req); err != nil {
+		return nil, err
+	}
+	id := req.GroupId
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.groups[id]; exists {
+		return nil, grpc.Errorf(codes.AlreadyExists, "Group %q already exists.", id)
+	}
+	s.groups[id] = proto.Clone(req).(*emulators.EmulatorGroup)
+	return EmptyPb, nil
+}
+
+func (s *server) GetGroup(ctx context.Context, req *emulators.GroupId) (*emulators.EmulatorGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, exists := s.groups[req.GroupId]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Group %q doesn't exist.", req.GroupId)
+	}
+	return proto.Clone(group).(*emulators.EmulatorGroup), nil
+}
+
+func (s *server) ListGroups(ctx context.Context, req *pb.Empty) (*emulators.ListGroupsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &emulators.ListGroupsResponse{}
+	for _, group := range s.groups {
+		resp.Groups = append(resp.Groups, proto.Clone(group).(*emulators.EmulatorGroup))
+	}
+	return resp, nil
+}
+
+func (s *server) DeleteGroup(ctx context.Context, req *emulators.GroupId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "DeleteGroup", req.GroupId, &err)
+	glog.V(1).Infof("DeleteGroup %v.", req.GroupId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.groups[req.GroupId]; !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Group %q doesn't exist.", req.GroupId)
+	}
+	delete(s.groups, req.GroupId)
+	return EmptyPb, nil
+}
+
+// Returns the emulator ids of the group. Returns NOT_FOUND if the group
+// doesn't exist.
+// REQUIRES s.mu.Lock().
+func (s *server) groupMembers(groupId string) ([]string, error) {
+	group, exists := s.groups[groupId]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Group %q doesn't exist.", groupId)
+	}
+	return append([]string(nil), group.EmulatorIds...), nil
+}
+
+func (s *server) StartGroup(ctx context.Context, req *emulators.GroupId) (_ *emulators.GroupResponse, err error) {
+	defer s.recordEvent(ctx, "StartGroup", req.GroupId, &err)
+	glog.V(1).Infof("StartGroup %v.", req.GroupId)
+	s.mu.Lock()
+	ids, err := s.groupMembers(req.GroupId)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*emulators.GroupMemberResult, len(ids))
+	// The emulators launched by this call, including dependencies that are not
+	// members, which are the only ones rolled back.
+	launched := make([][]string, len(ids))
+	failed := false
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			var err error
+			launched[i], err = s.startWithDependencies(ctx, id)
+			s.recordEvent(ctx, "StartEmulator", id, &err)
+			if grpc.Code(err) == codes.AlreadyExists {
+				// Already running.
+				err = nil
+			}
+			results[i] = groupMemberResult(id, err)
+			if err != nil {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	if failed {
+		rolledBack := make(map[string]bool)
+		for i := range ids {
+			// Dependents first, although stopping them cascades anyway.
+			for j := len(launched[i]) - 1; j >= 0; j-- {
+				id := launched[i][j]
+				if rolledBack[id] {
+					continue
+				}
+				rolledBack[id] = true
+				_, err := s.StopEmulatorCascade(ctx, &emulators.EmulatorId{EmulatorId: id})
+				if err != nil {
+					glog.Warningf("Failed to roll back emulator %q of group %q: %v", id, req.GroupId, err)
+				}
+			}
+		}
+		for i, id := range ids {
+			results[i].RolledBack = results[i].Error == "" && rolledBack[id]
+		}
+	}
+	return &emulators.GroupResponse{Results: results}, nil
+}
+
+func (s *server) StopGroup(ctx context.Context, req *emulators.StopGroupRequest) (_ *emulators.GroupResponse, err error) {
+	defer s.recordEvent(ctx, "StopGroup", req.GroupId, &err)
+	glog.V(1).Infof("StopGroup %v.", req.GroupId)
+	s.mu.Lock()
+	ids, err := s.groupMembers(req.GroupId)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	stop := s.StopEmulator
+	if req.Cascade {
+		stop = s.StopEmulatorCascade
+	}
+	results := make([]*emulators.GroupMemberResult, len(ids))
+	pending := make(map[int]bool)
+	for i := range ids {
+		pending[i] = true
+	}
+	for len(pending) > 0 {
+		// Stop the members that no pending member depends on, in parallel.
+		wave := s.nextStopWave(ids, pending)
+		var wg sync.WaitGroup
+		for _, i := range wave {
+			delete(pending, i)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := stop(ctx, &emulators.EmulatorId{EmulatorId: ids[i]})
+				results[i] = groupMemberResult(ids[i], err)
+			}(i)
+		}
+		wg.Wait()
+	}
+	return &emulators.GroupResponse{Results: results}, nil
+}
+
+// Returns the indexes of the pending members that no other pending member
+// depends on, directly or indirectly, while running.
+func (s *server) nextStopWave(ids []string, pending map[int]bool) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pendingIds := make(map[string]bool)
+	for i := range pending {
+		pendingIds[ids[i]] = true
+	}
+	var wave []int
+	for i := range ids {
+		if !pending[i] {
+			continue
+		}
+		blocked := false
+		for _, dependent := range s.runningDependents(ids[i]) {
+			if pendingIds[dependent] {
+				blocked = true
+				break
+			}
+		}
+		if !blocked {
+			wave = append(wave, i)
+		}
+	}
+	if len(wave) == 0 {
+		// Only possible if dependencies form a cycle, which CreateEmulator
+		// prevents. Stop all the pending members at once.
+		for i := range pending {
+			wave = append(wave, i)
+		}
+	}
+	return wave
+}
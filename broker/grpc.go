@@ -27,6 +27,7 @@ import (
 	"time"
 
 	glog "github.com/golang/glog"
+	proto "github.com/golang/protobuf/proto"
 	runtime "github.com/grpc-ecosystem/grpc-gateway/runtime"
 	context "golang.org/x/net/context"
 	grpc "google.golang.org/grpc"
@@ -53,8 +54,18 @@ func NewGrpcServer(host string, port int, brokerDir string, config *emulators.Br
 	var err error
 	if config != nil {
 		b.config = *config
+		b.s.config = proto.Clone(config).(*emulators.BrokerConfig)
+		b.s.emulatorLogLines = int(config.EmulatorLogLines)
+		b.s.emulatorLogDir = config.EmulatorLogDir
+		b.s.rejectAmbiguousMatches = config.RejectAmbiguousMatches
+		if config.EventJournalSize != 0 || config.EventJournalFile != "" {
+			b.s.journal, err = newEventJournal(int(config.EventJournalSize), config.EventJournalFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open event journal: %v", err)
+			}
+		}
 		if len(config.PortRanges) > 0 {
-			b.s.expander.portPicker, err = NewPortRangePicker(config.PortRanges)
+			b.s.expander.allocator.picker, err = NewPortRangePicker(config.PortRanges)
 			if err != nil {
 				return nil, err
 			}
@@ -71,6 +82,12 @@ func NewGrpcServer(host string, port int, brokerDir string, config *emulators.Br
 				return nil, err
 			}
 		}
+		for _, g := range config.Groups {
+			_, err = b.s.CreateGroup(nil, g)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if config.DefaultEmulatorStartDeadline != nil {
 			b.s.defaultStartDeadline = time.Duration(config.DefaultEmulatorStartDeadline.Seconds) * time.Second
 		}
@@ -132,6 +149,36 @@ func (b *grpcServer) Port() int {
 	return b.port
 }
 
+// StartGroup starts the emulators of the specified group, and returns an
+// error if any of them fails to start.
+func (b *grpcServer) StartGroup(groupId string) error {
+	resp, err := b.s.StartGroup(nil, &emulators.GroupId{GroupId: groupId})
+	if err != nil {
+		return err
+	}
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			return fmt.Errorf("emulator %q of group %q failed to start: %s", r.EmulatorId, groupId, r.Error)
+		}
+	}
+	return nil
+}
+
+// SetConfigLoader sets the function that loads the config again when it is
+// reloaded, e.g. by reading the config file.
+func (b *grpcServer) SetConfigLoader(load func() (*emulators.BrokerConfig, error)) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	b.s.loadConfig = load
+}
+
+// ReloadConfig loads the config again, and applies its changes to the
+// emulators, rules and groups. Changed emulators that are running are only
+// restarted if restartChanged is true.
+func (b *grpcServer) ReloadConfig(restartChanged bool) (*emulators.ReloadConfigResponse, error) {
+	return b.s.ReloadConfig(nil, &emulators.ReloadConfigRequest{RestartChanged: restartChanged})
+}
+
 func (s *grpcServer) shutdownHandler(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
 	w.Write([]byte("Shutting down...\n"))
 	go func() {
@@ -184,6 +231,7 @@ func (b *grpcServer) Shutdown() {
 	b.grpcServer.Stop()
 	b.mux.Close()
 	b.s.Clear()
+	b.s.journal.close()
 	b.waitGroup.Wait()
 	b.started = false
 }
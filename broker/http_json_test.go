@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -54,6 +55,10 @@ func (c *httpJsonClient) patch(url string, req proto.Message, output proto.Messa
 	return c.do("PATCH", url, req, output)
 }
 
+func (c *httpJsonClient) delete(url string) error {
+	return c.do("DELETE", url, nil, nil)
+}
+
 func (c *httpJsonClient) do(method string, url string, req proto.Message, output proto.Message) error {
 	var reqBody io.Reader = nil
 	if req != nil {
@@ -142,6 +147,27 @@ func (c *httpJsonClient) stopEmulator(id string) error {
 	return c.post(url, nil, nil)
 }
 
+func (c *httpJsonClient) deleteEmulator(id string) error {
+	url := fmt.Sprintf("http://localhost:%d/v1/emulators/%s", c.port, id)
+	return c.delete(url)
+}
+
+// Returns the raw response, since log lines are streamed as a sequence of Json
+// messages.
+func (c *httpJsonClient) getEmulatorLogs(id string, tail int) (string, error) {
+	url := fmt.Sprintf("http://localhost:%d/v1/emulators/%s/logs?tail=%d", c.port, id, tail)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errors.New("Request failed: " + resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
 func (c *httpJsonClient) createResolveRule(rule *emulators.ResolveRule) error {
 	url := fmt.Sprintf("http://localhost:%d/v1/resolve_rules", c.port)
 	return c.post(url, rule, nil)
@@ -168,6 +194,11 @@ func (c *httpJsonClient) updateResolveRule(rule *emulators.ResolveRule) (*emulat
 	return updatedRule, err
 }
 
+func (c *httpJsonClient) deleteResolveRule(id string) error {
+	url := fmt.Sprintf("http://localhost:%d/v1/resolve_rules/%s", c.port, id)
+	return c.delete(url)
+}
+
 func (c *httpJsonClient) resolve(req *emulators.ResolveRequest) (*emulators.ResolveResponse, error) {
 	url := fmt.Sprintf("http://localhost:%d/v1/resolve_rules:resolve", c.port)
 	resp := &emulators.ResolveResponse{}
@@ -175,6 +206,13 @@ func (c *httpJsonClient) resolve(req *emulators.ResolveRequest) (*emulators.Reso
 	return resp, err
 }
 
+func (c *httpJsonClient) batchResolve(req *emulators.BatchResolveRequest) (*emulators.BatchResolveResponse, error) {
+	url := fmt.Sprintf("http://localhost:%d/v1/resolve_rules:batchResolve", c.port)
+	resp := &emulators.BatchResolveResponse{}
+	err := c.post(url, req, resp)
+	return resp, err
+}
+
 // Sanity check HTTP/Json access to the emulators resource.
 // Tests create, get, and list.
 func TestHttpJson_EmulatorsResource(t *testing.T) {
@@ -359,3 +397,114 @@ func TestHttpJson_Resolve(t *testing.T) {
 		t.Fatalf("Expected bar: %v", resolveResp.Target)
 	}
 }
+
+// Tests resolve_rules:batchResolve.
+func TestHttpJson_BatchResolve(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	c := httpJsonClient{port: b.Port()}
+	err = c.awaitReady(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &emulators.ResolveRule{RuleId: "r0", TargetPatterns: []string{"foo"}, ResolvedHost: "bar"}
+	err = c.createResolveRule(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchResp, err := c.batchResolve(&emulators.BatchResolveRequest{
+		Requests: []*emulators.ResolveRequest{{Target: "foo"}, {Target: "baz"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batchResp.Results) != 2 || batchResp.Results[0].Response.Target != "bar" || batchResp.Results[1].Response.Target != "baz" {
+		t.Fatalf("Expected bar and baz: %v", batchResp.Results)
+	}
+}
+
+// Tests deletion of the emulators and resolve_rules resources.
+func TestHttpJson_Delete(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	c := httpJsonClient{port: b.Port()}
+	err = c.awaitReady(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.createEmulator(dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.createResolveRule(&emulators.ResolveRule{RuleId: "r0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.deleteResolveRule(dummyEmulator.Rule.RuleId)
+	if err == nil {
+		t.Fatalf("Expected deleting an emulator's rule to fail")
+	}
+	err = c.deleteResolveRule("r0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.deleteEmulator(dummyEmulator.EmulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listResp, err := c.listResolveRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listResp.Rules) != 0 {
+		t.Fatalf("Expected zero rules: %v", listResp)
+	}
+	emuResp, err := c.listEmulators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emuResp.Emulators) != 0 {
+		t.Fatalf("Expected zero emulators: %v", emuResp)
+	}
+}
+
+func TestHttpJson_GetEmulatorLogs(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	c := httpJsonClient{port: b.Port()}
+	err = c.awaitReady(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.createEmulator(realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.startEmulator(realEmulator.EmulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := c.getEmulatorLogs(realEmulator.EmulatorId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs, "serving on port") {
+		t.Errorf("Expected the emulator output: %s", logs)
+	}
+	_, err = c.getEmulatorLogs("unknown", 0)
+	if err == nil {
+		t.Error("Expected getting the logs of an unknown emulator to fail")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+	jsonpb "github.com/golang/protobuf/jsonpb"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	peer "google.golang.org/grpc/peer"
+	emulators "google/emulators"
+)
+
+const defaultEventJournalSize = 1000
+
+// eventJournal retains the most recent calls of mutating RPCs, and optionally
+// appends all of them to a file, as JSON lines.
+type eventJournal struct {
+	events []*emulators.BrokerEvent // A ring buffer.
+	total  int64                    // The number of events ever recorded.
+	file   *os.File
+	mu     sync.Mutex
+}
+
+// Creates a journal retaining size events, or defaultEventJournalSize if size
+// is not positive. If path is not empty, events are also appended to that
+// file.
+func newEventJournal(size int, path string) (*eventJournal, error) {
+	if size <= 0 {
+		size = defaultEventJournalSize
+	}
+	j := &eventJournal{events: make([]*emulators.BrokerEvent, size)}
+	if path != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// Records the event.
+func (j *eventJournal) record(event *emulators.BrokerEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.events[j.total%int64(len(j.events))] = event
+	j.total++
+	if j.file != nil {
+		m := jsonpb.Marshaler{OrigName: true}
+		err := m.Marshal(j.file, event)
+		if err == nil {
+			_, err = j.file.Write([]byte("\n"))
+		}
+		if err != nil {
+			glog.Warningf("Failed to write to %s: %v", j.file.Name(), err)
+		}
+	}
+}
+
+// Returns the retained events for the resource, or for all resources if
+// resourceId is empty, which were recorded at or after since, limited to the
+// last tail events if tail is positive.
+func (j *eventJournal) list(resourceId string, since time.Time, tail int) []*emulators.BrokerEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	first := j.total - int64(len(j.events))
+	if first < 0 {
+		first = 0
+	}
+	var events []*emulators.BrokerEvent
+	for i := first; i < j.total; i++ {
+		event := j.events[i%int64(len(j.events))]
+		if resourceId != "" && event.ResourceId != resourceId {
+			continue
+		}
+		if !since.IsZero() && fromTimestamp(event.Time).Before(since) {
+			continue
+		}
+		events = append(events, event)
+	}
+	if tail > 0 && len(events) > tail {
+		events = events[len(events)-tail:]
+	}
+	return events
+}
+
+// Closes the journal file, if any. Events recorded afterwards are only
+// retained in memory.
+func (j *eventJournal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// Records the outcome of a call to a mutating RPC, made for the emulator or
+// rule with the given id. To be deferred by the RPC, with a pointer to its
+// error result.
+func (s *server) recordEvent(ctx context.Context, method string, resourceId string, err *error) {
+	event := &emulators.BrokerEvent{
+		Time:       toTimestamp(time.Now()),
+		Method:     method,
+		ResourceId: resourceId,
+		Code:       grpc.Code(*err).String(),
+	}
+	if *err != nil {
+		event.Error = grpc.ErrorDesc(*err)
+	}
+	if ctx != nil {
+		if p, ok := peer.FromContext(ctx); ok {
+			event.Peer = p.Addr.String()
+		}
+	}
+	s.journal.record(event)
+}
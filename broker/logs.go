@@ -0,0 +1,138 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+	emulators "google/emulators"
+)
+
+const defaultEmulatorLogLines = 1000
+
+// emulatorLog retains the most recent output lines of an emulator, and
+// optionally appends all output to a file.
+type emulatorLog struct {
+	lines   []*emulators.LogLine // A ring buffer.
+	total   int64                // The number of lines ever written.
+	updated chan bool            // Closed and replaced when lines are written.
+	closed  bool
+	file    *os.File
+	mu      sync.Mutex
+}
+
+// Creates a log retaining size lines, or defaultEmulatorLogLines if size is
+// not positive. If path is not empty, output is also appended to that file.
+func newEmulatorLog(size int, path string) (*emulatorLog, error) {
+	if size <= 0 {
+		size = defaultEmulatorLogLines
+	}
+	l := &emulatorLog{lines: make([]*emulators.LogLine, size), updated: make(chan bool)}
+	if path != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Records a line written to stream. Lines written after the log is closed are
+// discarded.
+func (l *emulatorLog) write(stream emulators.LogLine_Stream, text string) {
+	now := time.Now()
+	line := &emulators.LogLine{Stream: stream, Time: toTimestamp(now), Text: text}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.lines[l.total%int64(len(l.lines))] = line
+	l.total++
+	if l.file != nil {
+		_, err := fmt.Fprintf(l.file, "%s %s: %s\n", now.Format(time.RFC3339Nano), stream, text)
+		if err != nil {
+			glog.Warningf("Failed to write to %s: %v", l.file.Name(), err)
+		}
+	}
+	close(l.updated)
+	l.updated = make(chan bool)
+}
+
+// Returns the retained lines, starting with the line at index from (counting
+// all lines ever written), and the index of the next line to be written.
+// Lines that are no longer retained are skipped. Also returns a channel that
+// is closed when more lines are written, or nil if the log is closed.
+func (l *emulatorLog) read(from int64) ([]*emulators.LogLine, int64, <-chan bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := l.total - int64(len(l.lines))
+	if first < 0 {
+		first = 0
+	}
+	if from < first {
+		from = first
+	}
+	var lines []*emulators.LogLine
+	for i := from; i < l.total; i++ {
+		lines = append(lines, l.lines[i%int64(len(l.lines))])
+	}
+	if l.closed {
+		return lines, l.total, nil
+	}
+	return lines, l.total, l.updated
+}
+
+// Stops recording lines, closes the log file, if any, and notifies readers.
+func (l *emulatorLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.updated)
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+// Returns the lines written at or after since, limited to the last tail lines
+// if tail is positive.
+func filterLogLines(lines []*emulators.LogLine, tail int, since time.Time) []*emulators.LogLine {
+	if !since.IsZero() {
+		i := 0
+		for i < len(lines) && fromTimestamp(lines[i].Time).Before(since) {
+			i++
+		}
+		lines = lines[i:]
+	}
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines
+}
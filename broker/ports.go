@@ -0,0 +1,104 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	glog "github.com/golang/glog"
+	emulators "google/emulators"
+)
+
+// portAllocator picks ports with a PortPicker, and keeps a ledger of which
+// emulator or proxy each picked port is leased to.
+type portAllocator struct {
+	picker PortPicker
+	leases map[int]*emulators.PortAllocation
+	mu     sync.Mutex
+}
+
+func newPortAllocator(picker PortPicker) *portAllocator {
+	return &portAllocator{picker: picker, leases: make(map[int]*emulators.PortAllocation)}
+}
+
+// Picks a port, and leases it to the owner. portName is the PORTNAME of the
+// token the port is picked for, if any.
+func (a *portAllocator) allocate(ownerType emulators.PortAllocation_OwnerType, ownerId string, portName string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	port, err := a.picker.Next()
+	if err != nil {
+		return 0, err
+	}
+	a.leases[port] = &emulators.PortAllocation{
+		Port:         int32(port),
+		OwnerType:    ownerType,
+		OwnerId:      ownerId,
+		PortName:     portName,
+		AllocateTime: toTimestamp(time.Now()),
+	}
+	glog.V(1).Infof("Allocated port %d to %s %q", port, ownerType, ownerId)
+	return port, nil
+}
+
+// Ends the lease of the port, and returns it to the picker.
+func (a *portAllocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lease, exists := a.leases[port]
+	if !exists {
+		return
+	}
+	glog.V(1).Infof("Released port %d from %s %q", port, lease.OwnerType, lease.OwnerId)
+	delete(a.leases, port)
+	if releaser, ok := a.picker.(PortReleaser); ok {
+		releaser.Release(port)
+	}
+}
+
+// Releases all ports leased to the owner.
+func (a *portAllocator) releaseOwner(ownerType emulators.PortAllocation_OwnerType, ownerId string) {
+	var ports []int
+	a.mu.Lock()
+	for port, lease := range a.leases {
+		if lease.OwnerType == ownerType && lease.OwnerId == ownerId {
+			ports = append(ports, port)
+		}
+	}
+	a.mu.Unlock()
+	for _, port := range ports {
+		a.release(port)
+	}
+}
+
+// Returns the current leases, ordered by port.
+func (a *portAllocator) list() []*emulators.PortAllocation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ports []int
+	for port := range a.leases {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	var leases []*emulators.PortAllocation
+	for _, port := range ports {
+		leases = append(leases, a.leases[port])
+	}
+	return leases
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	re "regexp"
+	"time"
+
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	emulators "google/emulators"
+)
+
+const (
+	defaultProbeTimeout             = time.Second
+	defaultReadinessCheckPeriod     = 200 * time.Millisecond
+	defaultLivenessCheckPeriod      = 10 * time.Second
+	defaultLivenessFailureThreshold = 3
+)
+
+// A single check of whether an emulator is serving. Returns nil on success.
+type prober func() error
+
+// Checks whether the probe is well-formed.
+func checkProbe(probe *emulators.Probe) error {
+	if probe == nil {
+		return errors.New("probe was not specified")
+	}
+	if toDuration(probe.Timeout, 0) < 0 {
+		return fmt.Errorf("probe.timeout is negative: %v", probe.Timeout)
+	}
+	if h := probe.GetHttpGet(); h != nil {
+		_, err := re.Compile(h.BodyRegexp)
+		if err != nil {
+			return fmt.Errorf("probe.http_get.body_regexp is invalid: %v", err)
+		}
+		return nil
+	}
+	if probe.GetTcpConnect() != nil || probe.GetGrpcHealth() != nil {
+		return nil
+	}
+	return errors.New("probe has no check")
+}
+
+// Checks whether the readiness check, if any, is valid.
+func checkReadinessCheck(check *emulators.ReadinessCheck) error {
+	if check == nil {
+		return nil
+	}
+	if err := checkProbe(check.Probe); err != nil {
+		return err
+	}
+	if toDuration(check.Period, 0) < 0 {
+		return fmt.Errorf("period is negative: %v", check.Period)
+	}
+	return nil
+}
+
+// Checks whether the liveness check, if any, is valid.
+func checkLivenessCheck(check *emulators.LivenessCheck) error {
+	if check == nil {
+		return nil
+	}
+	if err := checkProbe(check.Probe); err != nil {
+		return err
+	}
+	if toDuration(check.Period, 0) < 0 {
+		return fmt.Errorf("period is negative: %v", check.Period)
+	}
+	if check.FailureThreshold < 0 {
+		return fmt.Errorf("failure_threshold is negative: %d", check.FailureThreshold)
+	}
+	return nil
+}
+
+// Creates a prober for the probe. resolvedHost is the default address to
+// check. expand is used to expand special tokens in addresses and URLs.
+func newProber(probe *emulators.Probe, resolvedHost string, expand func(string) (string, error)) (prober, error) {
+	timeout := toDuration(probe.Timeout, defaultProbeTimeout)
+	addressOrDefault := func(address string) (string, error) {
+		if address == "" {
+			return resolvedHost, nil
+		}
+		return expand(address)
+	}
+
+	if h := probe.GetHttpGet(); h != nil {
+		url := fmt.Sprintf("http://%s/", resolvedHost)
+		if h.Url != "" {
+			var err error
+			url, err = expand(h.Url)
+			if err != nil {
+				return nil, err
+			}
+		}
+		bodyRegexp, err := re.Compile(h.BodyRegexp)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return probeHttpGet(url, int(h.Status), bodyRegexp, timeout)
+		}, nil
+	}
+	if t := probe.GetTcpConnect(); t != nil {
+		address, err := addressOrDefault(t.Address)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			conn, err := net.DialTimeout("tcp", address, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}, nil
+	}
+	if g := probe.GetGrpcHealth(); g != nil {
+		address, err := addressOrDefault(g.Address)
+		if err != nil {
+			return nil, err
+		}
+		service := g.Service
+		return func() error {
+			return probeGrpcHealth(address, service, timeout)
+		}, nil
+	}
+	return nil, errors.New("probe has no check")
+}
+
+func probeHttpGet(url string, status int, bodyRegexp *re.Regexp, timeout time.Duration) error {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	if bodyRegexp.String() == "" {
+		return nil
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bodyRegexp.Match(content) {
+		return fmt.Errorf("%s responded with non-matching content: %q", url, content)
+	}
+	return nil
+}
+
+func probeGrpcHealth(address string, service string, timeout time.Duration) error {
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(timeout))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s reported health status %s", address, resp.Status)
+	}
+	return nil
+}
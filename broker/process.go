@@ -17,9 +17,33 @@ limitations under the License.
 package broker
 
 import (
+	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
+	"time"
+
+	glog "github.com/golang/glog"
+	emulators "google/emulators"
+)
+
+const (
+	// How long to wait for a process tree to exit after the stop signal, by
+	// default, before sending SIGKILL.
+	defaultStopGracePeriod = 10 * time.Second
+	// How long to wait for a process tree to exit after SIGKILL.
+	killTimeout = 5 * time.Second
 )
 
+// Signals that may be used to stop a process tree, by name.
+var stopSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
 // Runs the command, and waits for completion.
 func RunProcessTree(cmd *exec.Cmd) error {
 	return runProcessTree(cmd)
@@ -41,3 +65,67 @@ func KillProcessTree(cmd *exec.Cmd) error {
 	}
 	return killProcessTree(cmd)
 }
+
+// Describes how a process exited, given its state after Wait().
+func processExit(state *os.ProcessState) *emulators.ProcessExit {
+	exit := &emulators.ProcessExit{ExitCode: -1}
+	if state == nil {
+		return exit
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		if state.Success() {
+			exit.ExitCode = 0
+		}
+		return exit
+	}
+	if status.Signaled() {
+		exit.Signal = status.Signal().String()
+		return exit
+	}
+	exit.ExitCode = int32(status.ExitStatus())
+	return exit
+}
+
+// Returns the signal with the given name, e.g. "SIGTERM", or def if the name is
+// empty.
+func parseStopSignal(name string, def syscall.Signal) (syscall.Signal, error) {
+	if name == "" {
+		return def, nil
+	}
+	sig, ok := stopSignals[name]
+	if !ok {
+		return def, fmt.Errorf("unsupported signal: %s", name)
+	}
+	return sig, nil
+}
+
+// Waits for the process tree of cmd to exit, after it has been signaled to
+// stop. exited must be closed once the process itself has been reaped. If the
+// tree has not exited when the grace period elapses, it is killed.
+func awaitProcessTreeExit(cmd *exec.Cmd, exited <-chan bool, grace time.Duration) error {
+	deadline := time.Now().Add(grace)
+	killed := false
+	for {
+		select {
+		case <-exited:
+			if !processTreeExists(cmd) {
+				return nil
+			}
+		default:
+		}
+		if time.Now().After(deadline) {
+			if killed {
+				return fmt.Errorf("process tree of %d did not exit after SIGKILL", cmd.Process.Pid)
+			}
+			glog.Warningf("Process tree of %d did not exit within %v, killing it", cmd.Process.Pid, grace)
+			err := signalProcessTree(cmd, syscall.SIGKILL)
+			if err != nil {
+				glog.Warningf("Failed to kill process tree of %d: %v", cmd.Process.Pid, err)
+			}
+			killed = true
+			deadline = time.Now().Add(killTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -34,9 +34,22 @@ func startProcessTree(cmd *exec.Cmd) error {
 }
 
 func killProcessTree(cmd *exec.Cmd) error {
+	return signalProcessTree(cmd, syscall.SIGINT)
+}
+
+// Sends sig to every process in the process group of cmd.
+func signalProcessTree(cmd *exec.Cmd, sig syscall.Signal) error {
 	if cmd.Process == nil {
 		return nil
 	}
 	gid := -cmd.Process.Pid
-	return syscall.Kill(gid, syscall.SIGINT)
+	return syscall.Kill(gid, sig)
+}
+
+// Returns whether any process in the process group of cmd still exists.
+func processTreeExists(cmd *exec.Cmd) bool {
+	if cmd.Process == nil {
+		return false
+	}
+	return syscall.Kill(-cmd.Process.Pid, 0) != syscall.ESRCH
 }
@@ -19,6 +19,7 @@ package broker
 import (
 	"fmt"
 	"os/exec"
+	"syscall"
 )
 
 func runProcessTree(cmd *exec.Cmd) error {
@@ -29,15 +30,23 @@ func startProcessTree(cmd *exec.Cmd) error {
 	return cmd.Start()
 }
 
-// We use "taskkill /T" to kill the process tree.
+// We use "taskkill /T" to kill the process tree. The process is reaped by
+// whoever started it.
 func killProcessTree(cmd *exec.Cmd) error {
 	if cmd.Process == nil {
 		return nil
 	}
-	err := exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprintf("%d", cmd.Process.Pid)).Run()
-	if err != nil {
-		return err
-	}
-	_, err = cmd.Process.Wait()
-	return err
+	return exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprintf("%d", cmd.Process.Pid)).Run()
+}
+
+// Signals are not supported on Windows, so the process tree is always
+// terminated forcibly.
+func signalProcessTree(cmd *exec.Cmd, sig syscall.Signal) error {
+	return killProcessTree(cmd)
+}
+
+// taskkill terminates the whole tree, so only the process itself needs to be
+// waited for.
+func processTreeExists(cmd *exec.Cmd) bool {
+	return false
 }
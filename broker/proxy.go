@@ -0,0 +1,155 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	glog "github.com/golang/glog"
+	http2 "golang.org/x/net/http2"
+	codes "google.golang.org/grpc/codes"
+	emulators "google/emulators"
+)
+
+// Returns the host that connections to the proxy should be forwarded to.
+type proxyResolver func() (string, error)
+
+// localProxy forwards connections made to its port to the resolved host of
+// an emulator. HTTP/1.x connections and HTTP/2 connections (including gRPC)
+// are both supported. Since the proxy is dedicated to a single emulator,
+// forwarding happens at the connection level: the resolved host is looked up
+// once per connection, after which bytes are copied in both directions.
+type localProxy struct {
+	proxy   *emulators.Proxy
+	resolve proxyResolver
+	mux     *listenerMux
+	closed  bool
+	mu      sync.Mutex
+}
+
+func newLocalProxy(proxy *emulators.Proxy, resolve proxyResolver) *localProxy {
+	return &localProxy{proxy: proxy, resolve: resolve}
+}
+
+// Starts listening on the proxy port. If the port is zero, any available port
+// is chosen, and the proxy port is updated accordingly.
+func (p *localProxy) start() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", p.proxy.Port))
+	if err != nil {
+		return err
+	}
+	p.proxy.Port = int32(lis.Addr().(*net.TCPAddr).Port)
+	p.mux = newListenerMux(lis)
+	go p.serve(p.mux.HTTPListener, false)
+	go p.serve(p.mux.HTTP2Listener, true)
+	glog.Infof("Proxy for %q listening on port %d", p.proxy.EmulatorId, p.proxy.Port)
+	return nil
+}
+
+// Accepts connections from l until it is closed.
+func (p *localProxy) serve(l net.Listener, isHTTP2 bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			glog.V(1).Infof("Proxy for %q stopped accepting: %v", p.proxy.EmulatorId, err)
+			return
+		}
+		go p.forward(conn, isHTTP2)
+	}
+}
+
+// Forwards conn to the resolved host. If there is no resolved host, an
+// UNAVAILABLE response is written instead.
+func (p *localProxy) forward(conn net.Conn, isHTTP2 bool) {
+	defer conn.Close()
+	host, err := p.resolve()
+	if err != nil {
+		glog.V(1).Infof("Proxy for %q rejecting connection: %v", p.proxy.EmulatorId, err)
+		p.reject(conn, isHTTP2, err)
+		return
+	}
+	backend, err := net.Dial("tcp", host)
+	if err != nil {
+		glog.Warningf("Proxy for %q failed to connect to %s: %v", p.proxy.EmulatorId, host, err)
+		p.reject(conn, isHTTP2, err)
+		return
+	}
+	defer backend.Close()
+	glog.V(2).Infof("Proxy for %q forwarding connection to %s", p.proxy.EmulatorId, host)
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(backend, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- true
+	}()
+	// When either side is done, the deferred closes unblock the other copy.
+	<-done
+}
+
+// Writes an UNAVAILABLE response to conn. gRPC requests receive a gRPC status,
+// and all other requests receive HTTP status 503.
+func (p *localProxy) reject(conn net.Conn, isHTTP2 bool, cause error) {
+	msg := fmt.Sprintf("Emulator %q is unavailable: %v", p.proxy.EmulatorId, cause)
+	if isHTTP2 {
+		s := &http2.Server{}
+		s.ServeConn(conn, &http2.ServeConnOpts{Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+					w.Header().Set("Content-Type", "application/grpc")
+					w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+					w.Header().Set("Grpc-Message", msg)
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				http.Error(w, msg, http.StatusServiceUnavailable)
+			})})
+		return
+	}
+	// Consume the request before responding, so the client sees the response.
+	_, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n"+
+		"Connection: close\r\n\r\n%s", len(msg)+1, msg+"\n")
+}
+
+// Stops accepting connections. Connections already being forwarded are not
+// interrupted.
+func (p *localProxy) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.mux == nil {
+		return nil
+	}
+	p.closed = true
+	glog.Infof("Proxy for %q shutting down", p.proxy.EmulatorId)
+	return p.mux.Close()
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"strings"
+	"time"
+
+	glog "github.com/golang/glog"
+	proto "github.com/golang/protobuf/proto"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	emulators "google/emulators"
+)
+
+// The kinds of ConfigChange.
+const (
+	emulatorChange = "emulator"
+	ruleChange     = "rule"
+	groupChange    = "group"
+	settingChange  = "setting"
+)
+
+// Describes a difference between a reloaded config and the broker.
+func configChange(kind string, id string, action emulators.ConfigChange_Action, err error) *emulators.ConfigChange {
+	change := &emulators.ConfigChange{Kind: kind, Id: id, Action: action, Code: grpc.Code(err).String()}
+	if err != nil {
+		change.Error = grpc.ErrorDesc(err)
+	}
+	return change
+}
+
+func (s *server) ReloadConfig(ctx context.Context, req *emulators.ReloadConfigRequest) (_ *emulators.ReloadConfigResponse, err error) {
+	defer s.recordEvent(ctx, "ReloadConfig", "", &err)
+	glog.V(1).Infof("ReloadConfig %v.", req)
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+	s.mu.Lock()
+	load := s.loadConfig
+	s.mu.Unlock()
+	if load == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "The broker was not started with a config file.")
+	}
+	config, err := load()
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Failed to load config: %v", err)
+	}
+	return s.applyConfig(config, req.RestartChanged), nil
+}
+
+// Applies the differences between the config and the broker: new emulators,
+// rules and groups are created, changed ones are replaced, and unchanged ones
+// are left alone. Running emulators are only replaced if restartChanged is
+// true, in which case they are stopped and started again.
+func (s *server) applyConfig(config *emulators.BrokerConfig, restartChanged bool) *emulators.ReloadConfigResponse {
+	resp := &emulators.ReloadConfigResponse{}
+	s.mu.Lock()
+	resp.Changes = s.reloadSettings(config)
+	s.mu.Unlock()
+	for _, e := range config.Emulators {
+		if change := s.reloadEmulator(e, restartChanged); change != nil {
+			resp.Changes = append(resp.Changes, change)
+		}
+	}
+	for _, r := range config.Rules {
+		if change := s.reloadRule(r); change != nil {
+			resp.Changes = append(resp.Changes, change)
+		}
+	}
+	for _, g := range config.Groups {
+		if change := s.reloadGroup(g); change != nil {
+			resp.Changes = append(resp.Changes, change)
+		}
+	}
+	for _, change := range resp.Changes {
+		if change.Error != "" {
+			glog.Warningf("Config reload: %s %q %s: %s", change.Kind, change.Id, change.Action, change.Error)
+		} else {
+			glog.Infof("Config reload: %s %q %s", change.Kind, change.Id, change.Action)
+		}
+	}
+	return resp
+}
+
+// Applies the settings of the config that can change while the broker is
+// running, and rejects changes to the others.
+// REQUIRES s.mu.Lock().
+func (s *server) reloadSettings(config *emulators.BrokerConfig) []*emulators.ConfigChange {
+	var changes []*emulators.ConfigChange
+	if !proto.Equal(s.config.DefaultEmulatorStartDeadline, config.DefaultEmulatorStartDeadline) {
+		s.config.DefaultEmulatorStartDeadline = config.DefaultEmulatorStartDeadline
+		s.defaultStartDeadline = time.Minute
+		if config.DefaultEmulatorStartDeadline != nil {
+			s.defaultStartDeadline = time.Duration(config.DefaultEmulatorStartDeadline.Seconds) * time.Second
+		}
+		changes = append(changes, configChange(settingChange, "default_emulator_start_deadline", emulators.ConfigChange_UPDATED, nil))
+	}
+	if s.config.RejectAmbiguousMatches != config.RejectAmbiguousMatches {
+		s.config.RejectAmbiguousMatches = config.RejectAmbiguousMatches
+		s.rejectAmbiguousMatches = config.RejectAmbiguousMatches
+		changes = append(changes, configChange(settingChange, "reject_ambiguous_matches", emulators.ConfigChange_UPDATED, nil))
+	}
+	fixed := []struct {
+		name    string
+		changed bool
+	}{
+		{"port_ranges", !proto.Equal(
+			&emulators.BrokerConfig{PortRanges: s.config.PortRanges},
+			&emulators.BrokerConfig{PortRanges: config.PortRanges})},
+		{"emulator_log_lines", s.config.EmulatorLogLines != config.EmulatorLogLines},
+		{"emulator_log_dir", s.config.EmulatorLogDir != config.EmulatorLogDir},
+		{"event_journal_size", s.config.EventJournalSize != config.EventJournalSize},
+		{"event_journal_file", s.config.EventJournalFile != config.EventJournalFile},
+	}
+	for _, setting := range fixed {
+		if setting.changed {
+			err := grpc.Errorf(codes.FailedPrecondition, "Setting %q only takes effect when the broker starts.", setting.name)
+			changes = append(changes, configChange(settingChange, setting.name, emulators.ConfigChange_REJECTED, err))
+		}
+	}
+	return changes
+}
+
+// Applies an emulator of a reloaded config. Returns nil if the emulator is
+// unchanged.
+func (s *server) reloadEmulator(spec *emulators.Emulator, restartChanged bool) *emulators.ConfigChange {
+	id := spec.EmulatorId
+	s.mu.Lock()
+	emu, exists := s.emulators[id]
+	unchanged := exists && proto.Equal(emu.spec, spec)
+	var state emulators.Emulator_State
+	if exists {
+		state = emu.State()
+	}
+	s.mu.Unlock()
+	if !exists {
+		_, err := s.CreateEmulator(nil, spec)
+		if err != nil {
+			return configChange(emulatorChange, id, emulators.ConfigChange_REJECTED, err)
+		}
+		return configChange(emulatorChange, id, emulators.ConfigChange_ADDED, nil)
+	}
+	if unchanged {
+		return nil
+	}
+	if err := s.checkEmulator(spec); err != nil {
+		return configChange(emulatorChange, id, emulators.ConfigChange_REJECTED, err)
+	}
+	stopped := state == emulators.Emulator_OFFLINE || state == emulators.Emulator_CRASHED
+	if !stopped {
+		if !restartChanged {
+			err := grpc.Errorf(codes.FailedPrecondition, "Emulator %q is %s, and restart_changed was not specified.", id, state)
+			return configChange(emulatorChange, id, emulators.ConfigChange_REJECTED, err)
+		}
+		_, err := s.StopEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			return configChange(emulatorChange, id, emulators.ConfigChange_REJECTED, err)
+		}
+	}
+	if err := s.replaceEmulator(spec); err != nil {
+		if !stopped {
+			// Start the emulator again, as it was.
+			if _, err := s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: id}); err != nil {
+				glog.Warningf("Failed to start emulator %q again: %v", id, err)
+			}
+		}
+		return configChange(emulatorChange, id, emulators.ConfigChange_REJECTED, err)
+	}
+	if stopped {
+		return configChange(emulatorChange, id, emulators.ConfigChange_UPDATED, nil)
+	}
+	_, err := s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+	return configChange(emulatorChange, id, emulators.ConfigChange_RESTARTED, err)
+}
+
+// Replaces an emulator that is not running with a valid spec. The emulator
+// keeps its log and proxy.
+func (s *server) replaceEmulator(spec *emulators.Emulator) error {
+	id := spec.EmulatorId
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	emu, exists := s.emulators[id]
+	if !exists {
+		return grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
+	}
+	if emu.running() || emu.State() == emulators.Emulator_STOPPING {
+		return grpc.Errorf(codes.FailedPrecondition, "Emulator %q is %s.", id, emu.State())
+	}
+	ruleId := spec.Rule.RuleId
+	if ruleId != emu.emulator.Rule.RuleId {
+		if _, exists := s.resolveRules[ruleId]; exists {
+			return grpc.Errorf(codes.AlreadyExists, "ResolveRule %q already exists.", ruleId)
+		}
+	}
+	if cycle := s.findDependencyCycle(id, spec.DependsOn); cycle != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Emulator %q: depends_on forms a cycle: %s", id, strings.Join(cycle, " -> "))
+	}
+	delete(s.resolveRules, emu.emulator.Rule.RuleId)
+	s.addEmulator(spec, emu.log)
+	return nil
+}
+
+// Applies a rule of a reloaded config. Returns nil if the rule is unchanged.
+func (s *server) reloadRule(rule *emulators.ResolveRule) *emulators.ConfigChange {
+	id := rule.RuleId
+	s.mu.Lock()
+	existing, exists := s.resolveRules[id]
+	unchanged := exists && proto.Equal(existing, rule)
+	s.mu.Unlock()
+	if !exists {
+		_, err := s.CreateResolveRule(nil, rule)
+		if err != nil {
+			return configChange(ruleChange, id, emulators.ConfigChange_REJECTED, err)
+		}
+		return configChange(ruleChange, id, emulators.ConfigChange_ADDED, nil)
+	}
+	if unchanged {
+		return nil
+	}
+	if err := s.checkResolveRule(rule); err != nil {
+		return configChange(ruleChange, id, emulators.ConfigChange_REJECTED, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if emu := s.findLocalEmulator(id); emu != nil {
+		err := grpc.Errorf(codes.FailedPrecondition, "Resolve rule %q belongs to emulator %q.", id, emu.emulator.EmulatorId)
+		return configChange(ruleChange, id, emulators.ConfigChange_REJECTED, err)
+	}
+	s.resolveRules[id] = proto.Clone(rule).(*emulators.ResolveRule)
+	s.ruleIndex.rebuild(s.resolveRules)
+	return configChange(ruleChange, id, emulators.ConfigChange_UPDATED, nil)
+}
+
+// Applies a group of a reloaded config. Returns nil if the group is
+// unchanged.
+func (s *server) reloadGroup(group *emulators.EmulatorGroup) *emulators.ConfigChange {
+	id := group.GroupId
+	s.mu.Lock()
+	existing, exists := s.groups[id]
+	unchanged := exists && proto.Equal(existing, group)
+	s.mu.Unlock()
+	if !exists {
+		_, err := s.CreateGroup(nil, group)
+		if err != nil {
+			return configChange(groupChange, id, emulators.ConfigChange_REJECTED, err)
+		}
+		return configChange(groupChange, id, emulators.ConfigChange_ADDED, nil)
+	}
+	if unchanged {
+		return nil
+	}
+	if err := checkGroup(group); err != nil {
+		return configChange(groupChange, id, emulators.ConfigChange_REJECTED, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[id] = proto.Clone(group).(*emulators.EmulatorGroup)
+	return configChange(groupChange, id, emulators.ConfigChange_UPDATED, nil)
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	re "regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	glog "github.com/golang/glog"
+	emulators "google/emulators"
+)
+
+var (
+	// Matches gRPC service method targets, e.g. "/google.pubsub.v1.Publisher/Publish".
+	serviceMethodMatcher = re.MustCompile("^/[\\w\\.]+/\\w+$")
+	// Matches host and host:port targets, including bracketed IPv6 addresses.
+	hostPortMatcher = re.MustCompile("^([\\w\\.-]+|\\[[0-9a-fA-F:\\.]+\\])(:\\d+)?$")
+)
+
+// The schemes that the broker chooses according to whether the resolved host
+// requires a secure connection, by their insecure counterpart.
+var secureSchemes = map[string]string{
+	"http": "https",
+	"ws":   "wss",
+}
+
+// Returns the scheme of the resolved target for a URL target with the given
+// scheme. Unknown schemes are preserved, unless the rule specifies a scheme.
+func resolveScheme(scheme string, rule *emulators.ResolveRule) string {
+	if rule.ResolvedScheme != "" {
+		return rule.ResolvedScheme
+	}
+	for insecure, secure := range secureSchemes {
+		if scheme == insecure || scheme == secure {
+			if rule.RequiresSecureConnection {
+				return secure
+			}
+			return insecure
+		}
+	}
+	return scheme
+}
+
+// Splits a resolved host into its host and port. The port is 0 if the
+// resolved host doesn't specify one.
+func splitResolvedHost(resolvedHost string) (string, int32) {
+	host, port, err := net.SplitHostPort(resolvedHost)
+	if err != nil {
+		return resolvedHost, 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return resolvedHost, 0
+	}
+	return host, int32(p)
+}
+
+// Checks whether the path rewrite, if any, is valid.
+func checkPathRewrite(rewrite *emulators.PathRewrite) error {
+	if rewrite == nil {
+		return nil
+	}
+	if !strings.HasPrefix(rewrite.Prefix, "/") {
+		return fmt.Errorf("prefix must start with /: %q", rewrite.Prefix)
+	}
+	if !strings.HasPrefix(rewrite.Replacement, "/") {
+		return fmt.Errorf("replacement must start with /: %q", rewrite.Replacement)
+	}
+	return nil
+}
+
+// Replaces the prefix of the path according to the rewrite, if any.
+func rewritePath(path string, rewrite *emulators.PathRewrite) string {
+	if rewrite == nil || !strings.HasPrefix(path, rewrite.Prefix) {
+		return path
+	}
+	return rewrite.Replacement + path[len(rewrite.Prefix):]
+}
+
+// ruleMatch describes how a rule matches a target.
+type ruleMatch struct {
+	rule *emulators.ResolveRule
+	// The target pattern with the longest match, its compiled form, and the
+	// length of that match.
+	pattern string
+	regexp  *re.Regexp
+	length  int
+}
+
+// Expands the template with the capture groups of the match in target, e.g.
+// "$1" or "${name}".
+func (m *ruleMatch) expand(template string, target string) string {
+	loc := m.regexp.FindStringSubmatchIndex(target)
+	if loc == nil {
+		return ""
+	}
+	return string(m.regexp.ExpandString(nil, template, target, loc))
+}
+
+// Whether m and other rank the same, i.e. neither is preferred.
+func (m *ruleMatch) ties(other *ruleMatch) bool {
+	return m.rule.Priority == other.rule.Priority && m.length == other.length
+}
+
+// Implements sort.Interface for []*ruleMatch, from the most preferred match to
+// the least: by priority, then by match length, then by rule id.
+type byPreference []*ruleMatch
+
+func (a byPreference) Len() int      { return len(a) }
+func (a byPreference) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byPreference) Less(i, j int) bool {
+	if a[i].rule.Priority != a[j].rule.Priority {
+		return a[i].rule.Priority > a[j].rule.Priority
+	}
+	if a[i].length != a[j].length {
+		return a[i].length > a[j].length
+	}
+	return a[i].rule.RuleId < a[j].rule.RuleId
+}
+
+// The maximum number of targets whose matches are cached by a ruleIndex.
+const maxCachedTargets = 4096
+
+// The length, in bytes, of the keys of the prefix index of a ruleIndex.
+const prefixKeyLength = 3
+
+// targetPattern is a compiled target pattern of a rule.
+type targetPattern struct {
+	rule    *emulators.ResolveRule
+	pattern string
+	regexp  *re.Regexp
+	// The literal prefix of the pattern, which every match contains.
+	prefix string
+	// The position of the pattern in rule.TargetPatterns.
+	order int
+}
+
+// Identifies an indexed target pattern, including everything that determines
+// how its rule ranks, so that a change to any of it changes the key.
+type targetPatternKey struct {
+	rule     *emulators.ResolveRule
+	pattern  string
+	order    int
+	priority int32
+}
+
+// ruleIndex finds the rules matching a target, without recompiling target
+// patterns, and caches the matches of recent targets. It must be rebuilt
+// whenever rules are created, replaced or deleted, or their target patterns or
+// priorities change. Rebuilding requires the server lock, and matching the
+// server read lock, so that targets can be matched concurrently.
+type ruleIndex struct {
+	// The compiled target patterns, by pattern.
+	compiled map[string]*re.Regexp
+	// The indexed target patterns of all rules.
+	patterns map[targetPatternKey]*targetPattern
+	// The target patterns whose literal prefix is at least prefixKeyLength
+	// bytes long, by the first prefixKeyLength bytes of their prefix. Since
+	// every match of a pattern contains its prefix, only the patterns keyed by
+	// a substring of a target need to be run.
+	byPrefix map[string][]*targetPattern
+	// The target patterns with shorter literal prefixes, which are run for
+	// every target.
+	unkeyed []*targetPattern
+	// The matches of recently resolved targets.
+	cache map[string][]*ruleMatch
+	// Guards cache.
+	mu sync.Mutex
+}
+
+func newRuleIndex() *ruleIndex {
+	return &ruleIndex{
+		compiled: make(map[string]*re.Regexp),
+		patterns: make(map[targetPatternKey]*targetPattern),
+		byPrefix: make(map[string][]*targetPattern),
+		cache:    make(map[string][]*ruleMatch)}
+}
+
+// Indexes the target patterns of the rules, compiling only the patterns that
+// were not indexed before. Only the cached targets that an added or removed
+// pattern matches are evicted from the cache, since the matches of the others
+// are unchanged.
+func (x *ruleIndex) rebuild(rules map[string]*emulators.ResolveRule) {
+	compiled := make(map[string]*re.Regexp)
+	patterns := make(map[targetPatternKey]*targetPattern)
+	for _, rule := range rules {
+		for i, pattern := range rule.TargetPatterns {
+			regexp, exists := x.compiled[pattern]
+			if !exists {
+				var err error
+				regexp, err = re.Compile(pattern)
+				if err != nil {
+					// This is unexpected, since we should have rejected bad expressions
+					// when the rule was being created. We log and move on.
+					glog.Warningf("Encountered invalid target pattern: %s", pattern)
+					continue
+				}
+			}
+			compiled[pattern] = regexp
+			prefix, _ := regexp.LiteralPrefix()
+			key := targetPatternKey{rule: rule, pattern: pattern, order: i, priority: rule.Priority}
+			patterns[key] = &targetPattern{rule: rule, pattern: pattern, regexp: regexp, prefix: prefix, order: i}
+		}
+	}
+	var changed []*targetPattern
+	for key, p := range patterns {
+		if _, exists := x.patterns[key]; !exists {
+			changed = append(changed, p)
+		}
+	}
+	for key, p := range x.patterns {
+		if _, exists := patterns[key]; !exists {
+			changed = append(changed, p)
+		}
+	}
+	x.compiled = compiled
+	x.patterns = patterns
+	x.byPrefix = make(map[string][]*targetPattern)
+	x.unkeyed = nil
+	for _, p := range patterns {
+		if len(p.prefix) < prefixKeyLength {
+			x.unkeyed = append(x.unkeyed, p)
+			continue
+		}
+		key := p.prefix[:prefixKeyLength]
+		x.byPrefix[key] = append(x.byPrefix[key], p)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for target := range x.cache {
+		for _, p := range changed {
+			if p.regexp.MatchString(target) {
+				delete(x.cache, target)
+				break
+			}
+		}
+	}
+}
+
+// Returns the matches of the rules for target, from the most preferred to the
+// least. The returned slice is shared with the cache, and must not be
+// modified.
+func (x *ruleIndex) match(target string) []*ruleMatch {
+	x.mu.Lock()
+	matches, cached := x.cache[target]
+	x.mu.Unlock()
+	if cached {
+		return matches
+	}
+	// The longest match of each rule, and the order of its pattern.
+	best := make(map[*emulators.ResolveRule]*ruleMatch)
+	order := make(map[*emulators.ResolveRule]int)
+	run := func(p *targetPattern) {
+		if !strings.Contains(target, p.prefix) {
+			return
+		}
+		loc := p.regexp.FindStringIndex(target)
+		if loc == nil {
+			return
+		}
+		length := loc[1] - loc[0]
+		m, exists := best[p.rule]
+		if !exists || length > m.length || (length == m.length && p.order < order[p.rule]) {
+			best[p.rule] = &ruleMatch{rule: p.rule, pattern: p.pattern, regexp: p.regexp, length: length}
+			order[p.rule] = p.order
+		}
+	}
+	for _, p := range x.unkeyed {
+		run(p)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i+prefixKeyLength <= len(target); i++ {
+		key := target[i : i+prefixKeyLength]
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, p := range x.byPrefix[key] {
+			run(p)
+		}
+	}
+	for _, m := range best {
+		matches = append(matches, m)
+	}
+	sort.Sort(byPreference(matches))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.cache) >= maxCachedTargets {
+		x.cache = make(map[string][]*ruleMatch)
+	}
+	x.cache[target] = matches
+	return matches
+}
+
+// Returns the ids of the rules whose matches tie with the preferred match,
+// including the preferred match itself. Returns nil if the preferred match is
+// unambiguous.
+func ambiguousRules(matches []*ruleMatch) []string {
+	var ids []string
+	for _, m := range matches {
+		if !m.ties(matches[0]) {
+			break
+		}
+		ids = append(ids, m.rule.RuleId)
+	}
+	if len(ids) < 2 {
+		return nil
+	}
+	return ids
+}
+
+// Describes the matches, for an explained ResolveResponse.
+func resolveCandidates(matches []*ruleMatch) []*emulators.ResolveCandidate {
+	var candidates []*emulators.ResolveCandidate
+	for i, m := range matches {
+		candidates = append(candidates, &emulators.ResolveCandidate{
+			RuleId:        m.rule.RuleId,
+			Priority:      m.rule.Priority,
+			TargetPattern: m.pattern,
+			MatchLength:   int32(m.length),
+			Selected:      i == 0,
+		})
+	}
+	return candidates
+}
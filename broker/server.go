@@ -24,10 +24,13 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	re "regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	glog "github.com/golang/glog"
@@ -45,20 +48,42 @@ var (
 	idMatcher   = re.MustCompile("^[\\w\\.-]+$")
 	portMatcher = re.MustCompile("{port:([\\w\\.-]+)}")
 	envMatcher  = re.MustCompile("{env:(\\w+)}")
+	hostMatcher = re.MustCompile("{host:([\\w\\.-]+)}")
 )
 
 type commandExpander struct {
-	brokerDir  string
-	ports      map[string]int
-	portPicker PortPicker
+	brokerDir string
+	ports     map[string]int
+	allocator *portAllocator
+	// The emulator that ports are allocated to.
+	owner string
+	// Returns the resolved host of an emulator, for host tokens.
+	hosts func(emulatorId string) (string, error)
 }
 
 func newCommandExpander(brokerDir string, portPicker PortPicker) *commandExpander {
-	expander := &commandExpander{brokerDir: brokerDir, portPicker: portPicker}
+	expander := &commandExpander{brokerDir: brokerDir, allocator: newPortAllocator(portPicker)}
 	expander.ports = make(map[string]int)
 	return expander
 }
 
+// Returns an expander with its own port substitution map, allocating ports to
+// the given emulator, and sharing the broker directory and port allocator of
+// this expander.
+func (expander *commandExpander) newScope(owner string) *commandExpander {
+	scope := &commandExpander{brokerDir: expander.brokerDir, allocator: expander.allocator, owner: owner, hosts: expander.hosts}
+	scope.ports = make(map[string]int)
+	return scope
+}
+
+// Releases the ports allocated by this expander, and forgets them.
+func (expander *commandExpander) releasePorts() {
+	for _, port := range expander.ports {
+		expander.allocator.release(port)
+	}
+	expander.ports = make(map[string]int)
+}
+
 // Expands special port and environment variable tokens in s, in-place. ports
 // is the existing port substitution map, which may be modified by this
 // function. pickPort is used to pick new ports.
@@ -70,7 +95,7 @@ func (expander *commandExpander) expandSpecialTokens(s *string) error {
 			for _, portName := range submatches[1:] {
 				_, exists := (expander.ports)[portName]
 				if !exists {
-					port, err := expander.portPicker.Next()
+					port, err := expander.allocator.allocate(emulators.PortAllocation_EMULATOR, expander.owner, portName)
 					if err != nil {
 						return fmt.Errorf("Failed to expand port token: %v", err)
 					}
@@ -95,13 +120,24 @@ func (expander *commandExpander) expandSpecialTokens(s *string) error {
 			*s = strings.Replace(*s, fmt.Sprintf("{env:%s}", envName), env, -1)
 		}
 	}
+	for _, submatches := range hostMatcher.FindAllStringSubmatch(*s, -1) {
+		if expander.hosts == nil {
+			return fmt.Errorf("Failed to expand host token: no emulators")
+		}
+		host, err := expander.hosts(submatches[1])
+		if err != nil {
+			return fmt.Errorf("Failed to expand host token: %v", err)
+		}
+		*s = strings.Replace(*s, submatches[0], host, -1)
+	}
 	// Broker directory.
 	*s = strings.Replace(*s, "{dir:broker}", expander.brokerDir, -1)
 	return nil
 }
 
-// Expands special port and environment variable tokens in the path and args
-// of the specified command. pickPort is used to pick new ports.
+// Expands special port and environment variable tokens in the path, args,
+// environment variable values and working directory of the specified command.
+// pickPort is used to pick new ports.
 func (expander *commandExpander) expand(command *emulators.CommandLine) error {
 	err := expander.expandSpecialTokens(&command.Path)
 	if err != nil {
@@ -113,75 +149,352 @@ func (expander *commandExpander) expand(command *emulators.CommandLine) error {
 			return err
 		}
 	}
+	for name, value := range command.Env {
+		err = expander.expandSpecialTokens(&value)
+		if err != nil {
+			return err
+		}
+		command.Env[name] = value
+	}
+	return expander.expandSpecialTokens(&command.WorkingDir)
+}
+
+// Returns the names of the port tokens in the command, and in others.
+func portNames(command *emulators.CommandLine, others ...string) []string {
+	return tokenNames(portMatcher, command, others...)
+}
+
+// Returns the emulator ids of the host tokens in the command.
+func hostNames(command *emulators.CommandLine) []string {
+	return tokenNames(hostMatcher, command)
+}
+
+// Returns the values of the command, if any, that may contain special tokens,
+// and others.
+func commandValues(command *emulators.CommandLine, others ...string) []string {
+	if command == nil {
+		return others
+	}
+	values := append([]string{command.Path, command.WorkingDir}, command.Args...)
+	for _, value := range command.Env {
+		values = append(values, value)
+	}
+	return append(values, others...)
+}
+
+// Returns the names of the tokens matched by matcher in the command, and in
+// others.
+func tokenNames(matcher *re.Regexp, command *emulators.CommandLine, others ...string) []string {
+	var names []string
+	for _, value := range commandValues(command, others...) {
+		for _, submatches := range matcher.FindAllStringSubmatch(value, -1) {
+			names = append(names, submatches[1])
+		}
+	}
+	return names
+}
+
+// Checks whether the environment variable names of the command are valid.
+func checkCommandEnv(command *emulators.CommandLine) error {
+	for name := range command.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid environment variable name: %q", name)
+		}
+	}
 	return nil
 }
 
+// Returns the environment for the command, in the form of exec.Cmd.Env, or
+// nil if the command simply inherits the environment of the broker.
+func commandEnv(command *emulators.CommandLine) []string {
+	inherit := command.InheritEnv == nil || command.InheritEnv.Value
+	if inherit && len(command.Env) == 0 {
+		return nil
+	}
+	vars := make(map[string]string)
+	if inherit {
+		for _, kv := range os.Environ() {
+			if i := strings.Index(kv, "="); i > 0 {
+				vars[kv[:i]] = kv[i+1:]
+			}
+		}
+	} else if addr, ok := os.LookupEnv(BrokerAddressEnv); ok {
+		// Emulators need the broker address to register with the broker.
+		vars[BrokerAddressEnv] = addr
+	}
+	for name, value := range command.Env {
+		vars[name] = value
+	}
+	env := []string{}
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Called when the process of an emulator exits, with the command that started
+// the process and the state it exited with.
+type exitHandler func(emu *localEmulator, cmd *exec.Cmd, state *os.ProcessState)
+
+// Called when the process of an emulator has been launched with cmd.
+type launchHandler func(emu *localEmulator, cmd *exec.Cmd)
+
+// Called when the state or resolved host of an emulator changes, or its
+// process exits.
+type changeHandler func(event *emulators.EmulatorEvent)
+
 type localEmulator struct {
-	emulator *emulators.Emulator
-	cmd      *exec.Cmd
-	expander *commandExpander
+	emulator     *emulators.Emulator
+	cmd          *exec.Cmd
+	expander     *commandExpander
+	onLaunch     launchHandler
+	onExit       exitHandler
+	onChange     changeHandler
+	restartTimer *time.Timer
+	// Whether the current process is being killed to be restarted, regardless
+	// of the restart policy.
+	restartOnExit bool
+	// Closed when the current process exits.
+	exited chan bool
+	// Waits for the current process tree to exit, while STOPPING.
+	awaitStop func() error
+	// The output of the emulator, across restarts.
+	log *emulatorLog
+	// The resolved host of the emulator's rule, as specified with port tokens.
+	resolvedHostTemplate string
+	// The emulator as it was created, before the broker changed its state.
+	spec *emulators.Emulator
 }
 
 func (emu *localEmulator) start() error {
-	if emu.emulator.State != emulators.Emulator_OFFLINE {
-		return fmt.Errorf("Emulator %q cannot be started because it is in state %q.", emu.emulator, emu.emulator.State)
+	if emu.running() || emu.emulator.State == emulators.Emulator_STOPPING {
+		return fmt.Errorf("Emulator %q cannot be started because it is in state %q.", emu.emulator.EmulatorId, emu.emulator.State)
 	}
+	emu.emulator.RestartCount = 0
+	return emu.launch()
+}
 
-	startCommand := emu.emulator.StartCommand
+// Launches the emulator process, regardless of the current state. The start
+// command is expanded anew, so that it remains a template; ports picked for a
+// previous launch are reused until they are released.
+func (emu *localEmulator) launch() error {
+	startCommand := proto.Clone(emu.emulator.StartCommand).(*emulators.CommandLine)
+	templates := []string{emu.resolvedHostTemplate}
+	if check := emu.emulator.ReadinessCheck; check != nil {
+		templates = append(templates, check.ResolvedHost)
+	}
+	names := portNames(startCommand, templates...)
 	err := emu.expander.expand(startCommand)
 	if err != nil {
 		return err
 	}
+	// Pick the ports of the templates too, so all of them are recorded.
+	for _, t := range templates {
+		err = emu.expander.expandSpecialTokens(&t)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if emu.emulator.Ports == nil {
+			emu.emulator.Ports = make(map[string]int32)
+		}
+		emu.emulator.Ports[name] = int32(emu.expander.ports[name])
+	}
 	cmd := exec.Command(startCommand.Path, startCommand.Args...)
+	cmd.Dir = startCommand.WorkingDir
+	cmd.Env = commandEnv(startCommand)
 
-	// Create stdout, stderr streams of type io.Reader
+	// Create stdout, stderr streams of type io.ReadCloser
 	pout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	go outputLogPrefixer(emu.emulator.EmulatorId, pout)
+	go outputLogPrefixer(emu.emulator.EmulatorId, pout, emu.log, emulators.LogLine_STDOUT)
 
 	perr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
 	}
-	go outputLogPrefixer(emu.emulator.EmulatorId, perr)
-	emu.cmd = cmd
-	emu.emulator.State = emulators.Emulator_STARTING
+	go outputLogPrefixer(emu.emulator.EmulatorId, perr, emu.log, emulators.LogLine_STDERR)
 
 	glog.Infof("Starting %q", emu.emulator.EmulatorId)
 
+	emu.cmd = cmd
+	emu.setState(emulators.Emulator_STARTING)
+	emu.emulator.Health = nil
+	emu.restartOnExit = false
+	emu.exited = make(chan bool)
+
 	err = StartProcessTree(emu.cmd)
 	if err != nil {
-		glog.Warningf("Error starting %q", emu.emulator.EmulatorId)
+		glog.Warningf("Error starting %q: %v", emu.emulator.EmulatorId, err)
+		emu.cmd = nil
+		return err
+	}
+	go emu.supervise(cmd, emu.exited)
+	if emu.onLaunch != nil {
+		emu.onLaunch(emu, cmd)
 	}
 	return nil
 }
 
+// Waits for the process started by cmd to exit, reports the exit to the exit
+// handler, and closes exited. The process is reaped directly, rather than with
+// cmd.Wait(), so that output still buffered in the pipes can be read to the
+// end.
+func (emu *localEmulator) supervise(cmd *exec.Cmd, exited chan bool) {
+	state, err := cmd.Process.Wait()
+	if err != nil {
+		glog.Warningf("Error waiting for %q: %v", emu.emulator.EmulatorId, err)
+	}
+	if emu.onExit != nil {
+		emu.onExit(emu, cmd, state)
+	}
+	close(exited)
+}
+
+// Returns whether the emulator has been restarted as many times as its restart
+// policy allows.
+func (emu *localEmulator) retriesExhausted() bool {
+	policy := emu.emulator.RestartPolicy
+	return policy != nil && policy.MaxRetries > 0 && emu.emulator.RestartCount >= policy.MaxRetries
+}
+
+// Returns whether the emulator should be restarted after its process exited
+// unexpectedly, according to its restart policy.
+func (emu *localEmulator) shouldRestart(exit *emulators.ProcessExit) bool {
+	policy := emu.emulator.RestartPolicy
+	if policy == nil || emu.retriesExhausted() {
+		return false
+	}
+	switch policy.Mode {
+	case emulators.RestartPolicy_ALWAYS:
+		return true
+	case emulators.RestartPolicy_ON_FAILURE:
+		return exit.ExitCode != 0
+	}
+	return false
+}
+
+// Returns the delay before the next restart, which doubles with every restart.
+func (emu *localEmulator) restartBackoff() time.Duration {
+	policy := emu.emulator.RestartPolicy
+	delay := toDuration(policy.GetInitialBackoff(), time.Second)
+	max := toDuration(policy.GetMaxBackoff(), 30*time.Second)
+	for i := int32(0); i < emu.emulator.RestartCount && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Releases the ports picked for the emulator, once it is no longer running.
+func (emu *localEmulator) releasePorts() {
+	emu.expander.releasePorts()
+	emu.emulator.Ports = nil
+}
+
+// Returns whether the emulator process is running, i.e. STARTING or ONLINE.
+// An emulator waiting to be restarted is STARTING. A STOPPING emulator is not
+// considered to be running.
+func (emu *localEmulator) running() bool {
+	state := emu.emulator.State
+	return state == emulators.Emulator_STARTING || state == emulators.Emulator_ONLINE
+}
+
 func (emu *localEmulator) markStartingForTest() error {
 	if emu.emulator.State != emulators.Emulator_OFFLINE {
 		return fmt.Errorf("Emulator %q cannot be marked STARTING: %s", emu.emulator.EmulatorId, emu.emulator.State)
 	}
-	emu.emulator.State = emulators.Emulator_STARTING
+	emu.setState(emulators.Emulator_STARTING)
 	return nil
 }
 
+// Sets the state of the emulator, and reports the change.
+func (emu *localEmulator) setState(state emulators.Emulator_State) {
+	previous := emu.emulator.State
+	if previous == state {
+		return
+	}
+	emu.emulator.State = state
+	emu.notify(emulators.EmulatorEvent_STATE_CHANGED, previous)
+}
+
+// Sets the resolved host of the emulator's rule, and reports the change.
+func (emu *localEmulator) setResolvedHost(resolvedHost string) {
+	if emu.emulator.Rule.ResolvedHost == resolvedHost {
+		return
+	}
+	emu.emulator.Rule.ResolvedHost = resolvedHost
+	emu.notify(emulators.EmulatorEvent_RESOLVED_HOST_CHANGED, emu.emulator.State)
+}
+
+// Reports an event about the emulator, as it is now, to the change handler.
+func (emu *localEmulator) notify(eventType emulators.EmulatorEvent_Type, previousState emulators.Emulator_State) {
+	if emu.onChange == nil {
+		return
+	}
+	emu.onChange(&emulators.EmulatorEvent{
+		Type:          eventType,
+		EmulatorId:    emu.emulator.EmulatorId,
+		Emulator:      proto.Clone(emu.emulator).(*emulators.Emulator),
+		PreviousState: previousState,
+		Time:          toTimestamp(time.Now()),
+	})
+}
+
 func (emu *localEmulator) markOnline() error {
 	if emu.emulator.State != emulators.Emulator_STARTING {
 		return fmt.Errorf("Emulator %q cannot be marked ONLINE: %s", emu.emulator.EmulatorId, emu.emulator.State)
 	}
-	emu.emulator.State = emulators.Emulator_ONLINE
+	emu.setState(emulators.Emulator_ONLINE)
 	return nil
 }
 
-func (emu *localEmulator) kill() error {
-	if emu.emulator.State == emulators.Emulator_OFFLINE {
-		glog.V(1).Infof("Emulator %q cannot be killed because it is not running", emu.emulator.EmulatorId)
-		return nil
+// Begins stopping the emulator, by cancelling any pending restart and sending
+// the stop signal to its process tree. The emulator is STOPPING until its
+// process tree exits. Returns a function that waits for the process tree to
+// exit, killing it if the grace period elapses first, which must be called
+// without holding the server lock.
+func (emu *localEmulator) stop() func() error {
+	if emu.restartTimer != nil {
+		emu.restartTimer.Stop()
+		emu.restartTimer = nil
 	}
-	err := KillProcessTree(emu.cmd)
-	emu.emulator.State = emulators.Emulator_OFFLINE
-	return err
+	if emu.emulator.State == emulators.Emulator_STOPPING {
+		return emu.awaitStop
+	}
+	noWait := func() error { return nil }
+	if !emu.running() {
+		glog.V(1).Infof("Emulator %q cannot be stopped because it is not running", emu.emulator.EmulatorId)
+		emu.setState(emulators.Emulator_OFFLINE)
+		emu.releasePorts()
+		return noWait
+	}
+	cmd := emu.cmd
+	if cmd == nil || cmd.Process == nil {
+		// The process was never started, or is waiting to be restarted.
+		emu.setState(emulators.Emulator_OFFLINE)
+		emu.releasePorts()
+		return noWait
+	}
+	// The stop signal is validated when the emulator is created.
+	sig, _ := parseStopSignal(emu.emulator.StopSignal, syscall.SIGTERM)
+	grace := toDuration(emu.emulator.StopGracePeriod, defaultStopGracePeriod)
+	glog.Infof("Stopping %q with %s", emu.emulator.EmulatorId, sig)
+	if err := signalProcessTree(cmd, sig); err != nil {
+		glog.Warningf("Failed to signal %q: %v", emu.emulator.EmulatorId, err)
+	}
+	emu.setState(emulators.Emulator_STOPPING)
+	exited := emu.exited
+	emu.awaitStop = func() error {
+		return awaitProcessTreeExit(cmd, exited, grace)
+	}
+	return emu.awaitStop
 }
 
 func (emu *localEmulator) Emulator() *emulators.Emulator {
@@ -192,38 +505,106 @@ func (emu *localEmulator) State() emulators.Emulator_State {
 	return emu.emulator.State
 }
 
-type localProxy struct {
-	proxy *emulators.Proxy
-}
-
 type server struct {
 	emulators            map[string]*localEmulator
 	resolveRules         map[string]*emulators.ResolveRule
+	ruleIndex            *ruleIndex
 	proxies              map[string]*localProxy
+	groups               map[string]*emulators.EmulatorGroup
 	expander             *commandExpander
 	defaultStartDeadline time.Duration
-	mu                   sync.Mutex
+	emulatorLogLines     int
+	emulatorLogDir       string
+	// Whether Resolve() fails when several rules match a target equally well.
+	rejectAmbiguousMatches bool
+	watchers               map[*emulatorWatcher]bool
+	journal                *eventJournal
+	// The settings of the config the broker was started with, as updated by
+	// ReloadConfig().
+	config *emulators.BrokerConfig
+	// Loads the config again, for ReloadConfig(). Nil if the broker has no
+	// config file.
+	loadConfig func() (*emulators.BrokerConfig, error)
+	// Serializes ReloadConfig() calls.
+	reloading sync.Mutex
+	// Closed and replaced whenever an emulator changes.
+	changed chan bool
+	// Resolve() only needs the read lock, so that targets are resolved
+	// concurrently.
+	mu sync.RWMutex
 }
 
 func New() *server {
 	glog.Infof("Server created.")
-	s := server{expander: newCommandExpander("", &FreePortPicker{}), defaultStartDeadline: time.Minute}
+	journal, _ := newEventJournal(defaultEventJournalSize, "")
+	s := server{
+		expander:             newCommandExpander("", &FreePortPicker{}),
+		defaultStartDeadline: time.Minute,
+		watchers:             make(map[*emulatorWatcher]bool),
+		ruleIndex:            newRuleIndex(),
+		journal:              journal,
+		config:               &emulators.BrokerConfig{},
+		changed:              make(chan bool)}
+	s.expander.hosts = s.emulatorHost
 	s.Clear()
 	return &s
 }
 
-// Cleans up this instance, namely its emulators map, killing any that are running.
+// Cleans up this instance, namely its emulators map, killing any that are
+// running, its proxies map, shutting down their listeners, and its groups.
 func (s *server) Clear() {
 	s.mu.Lock()
+	var waits []func() error
+	var cleared []*localEmulator
 	for _, emu := range s.emulators {
-		emu.kill()
+		waits = append(waits, emu.stop())
+		cleared = append(cleared, emu)
+	}
+	for _, p := range s.proxies {
+		s.closeProxy(p)
 	}
 	s.emulators = make(map[string]*localEmulator)
 	s.resolveRules = make(map[string]*emulators.ResolveRule)
+	s.ruleIndex.rebuild(s.resolveRules)
 	s.proxies = make(map[string]*localProxy)
+	s.groups = make(map[string]*emulators.EmulatorGroup)
+	s.mu.Unlock()
+
+	// Wait for all emulators to stop in parallel.
+	var wg sync.WaitGroup
+	for _, wait := range waits {
+		wg.Add(1)
+		go func(wait func() error) {
+			defer wg.Done()
+			if err := wait(); err != nil {
+				glog.Warningf("Error stopping emulator: %v", err)
+			}
+		}(wait)
+	}
+	wg.Wait()
+	s.mu.Lock()
+	for _, emu := range cleared {
+		emu.releasePorts()
+		emu.log.close()
+	}
 	s.mu.Unlock()
 }
 
+// Stops the emulator, and waits for its process tree to exit.
+// REQUIRES s.mu.Lock(), which is released while waiting.
+func (s *server) stopEmulator(emu *localEmulator) error {
+	cmd := emu.cmd
+	wait := emu.stop()
+	s.mu.Unlock()
+	err := wait()
+	s.mu.Lock()
+	if emu.cmd == cmd && emu.State() == emulators.Emulator_STOPPING {
+		emu.setState(emulators.Emulator_OFFLINE)
+		emu.releasePorts()
+	}
+	return err
+}
+
 // Checks whether the target pattern expressions are valid.
 func (s *server) checkTargetPatterns(patterns []string) error {
 	for _, p := range patterns {
@@ -235,34 +616,33 @@ func (s *server) checkTargetPatterns(patterns []string) error {
 	return nil
 }
 
-// Creates a spec to resolve targets to specified emulator endpoints.
-// If a spec with this id already exists, returns ALREADY_EXISTS.
-func (s *server) CreateEmulator(ctx context.Context, req *emulators.Emulator) (*pb.Empty, error) {
-	glog.V(1).Infof("CreateEmulator %v.", req)
-	id := req.EmulatorId
-	if req.EmulatorId == "" {
-		return nil, grpc.Errorf(codes.InvalidArgument, "emulator.emulator_id was not specified")
+// Checks whether the restart policy, if any, is valid.
+func checkRestartPolicy(policy *emulators.RestartPolicy) error {
+	if policy == nil {
+		return nil
 	}
-	if !idMatcher.MatchString(req.EmulatorId) {
-		return nil, grpc.Errorf(codes.InvalidArgument, "emulator.emulator_id contains invalid characters")
+	if policy.MaxRetries < 0 {
+		return fmt.Errorf("max_retries is negative: %d", policy.MaxRetries)
 	}
-	if req.StartCommand == nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, "emulator.start_command was not specified")
+	if toDuration(policy.InitialBackoff, 0) < 0 {
+		return fmt.Errorf("initial_backoff is negative: %v", policy.InitialBackoff)
 	}
-	if req.StartCommand.Path == "" {
-		return nil, grpc.Errorf(codes.InvalidArgument, "emulator.start_command.path was not specified")
+	if toDuration(policy.MaxBackoff, 0) < 0 {
+		return fmt.Errorf("max_backoff is negative: %v", policy.MaxBackoff)
 	}
-	if req.Rule == nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, "Emulator %q: rule was not specified", id)
+	return nil
+}
+
+// Creates a spec to resolve targets to specified emulator endpoints.
+// If a spec with this id already exists, returns ALREADY_EXISTS.
+func (s *server) CreateEmulator(ctx context.Context, req *emulators.Emulator) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "CreateEmulator", req.EmulatorId, &err)
+	glog.V(1).Infof("CreateEmulator %v.", req)
+	if err := s.checkEmulator(req); err != nil {
+		return nil, err
 	}
+	id := req.EmulatorId
 	ruleId := req.Rule.RuleId
-	if ruleId == "" {
-		return nil, grpc.Errorf(codes.InvalidArgument, "Emulator %q: rule.rule_id was not specified", id)
-	}
-	err := s.checkTargetPatterns(req.Rule.TargetPatterns)
-	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, "Emulator %q: rule.target_patterns invalid: %v", err)
-	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -274,12 +654,120 @@ func (s *server) CreateEmulator(ctx context.Context, req *emulators.Emulator) (*
 	if exists {
 		return nil, grpc.Errorf(codes.AlreadyExists, "ResolveRule %q already exists.", ruleId)
 	}
+	if cycle := s.findDependencyCycle(id, req.DependsOn); cycle != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Emulator %q: depends_on forms a cycle: %s", id, strings.Join(cycle, " -> "))
+	}
+	logPath := ""
+	if s.emulatorLogDir != "" {
+		logPath = filepath.Join(s.emulatorLogDir, id+".log")
+	}
+	log, err := newEmulatorLog(s.emulatorLogLines, logPath)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Emulator %q: failed to open log: %v", id, err)
+	}
+	s.addEmulator(req, log)
+	return EmptyPb, nil
+}
+
+// Checks whether the emulator is valid, on its own. Returns INVALID_ARGUMENT
+// for the first of its problems, if it is not.
+func (s *server) checkEmulator(req *emulators.Emulator) error {
+	if problems := s.emulatorProblems(req); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
 
-	emu := localEmulator{emulator: proto.Clone(req).(*emulators.Emulator), expander: s.expander}
+// Returns all the problems of the emulator, on its own, as INVALID_ARGUMENT
+// errors.
+func (s *server) emulatorProblems(req *emulators.Emulator) []error {
+	var problems []error
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, grpc.Errorf(codes.InvalidArgument, format, a...))
+	}
+	id := req.EmulatorId
+	if req.EmulatorId == "" {
+		report("emulator.emulator_id was not specified")
+	} else if !idMatcher.MatchString(req.EmulatorId) {
+		report("emulator.emulator_id contains invalid characters")
+	}
+	if req.StartCommand == nil {
+		report("emulator.start_command was not specified")
+	} else {
+		if req.StartCommand.Path == "" {
+			report("emulator.start_command.path was not specified")
+		}
+		if err := checkCommandEnv(req.StartCommand); err != nil {
+			report("Emulator %q: start_command.env invalid: %v", id, err)
+		}
+	}
+	if req.Rule == nil {
+		report("Emulator %q: rule was not specified", id)
+	}
+	if err := checkRestartPolicy(req.RestartPolicy); err != nil {
+		report("Emulator %q: restart_policy invalid: %v", id, err)
+	}
+	if err := checkReadinessCheck(req.ReadinessCheck); err != nil {
+		report("Emulator %q: readiness_check invalid: %v", id, err)
+	} else if req.ReadinessCheck != nil && req.ReadinessCheck.ResolvedHost == "" &&
+		(req.Rule == nil || !portMatcher.MatchString(req.Rule.ResolvedHost)) {
+		report("Emulator %q: readiness_check.resolved_host was not specified", id)
+	}
+	if req.ReadinessCheck == nil && req.Rule != nil && portMatcher.MatchString(req.Rule.ResolvedHost) {
+		// The broker couldn't tell when the emulator is serving.
+		report("Emulator %q: readiness_check is required when rule.resolved_host has port tokens", id)
+	}
+	if err := checkLivenessCheck(req.LivenessCheck); err != nil {
+		report("Emulator %q: liveness_check invalid: %v", id, err)
+	}
+	if _, err := parseStopSignal(req.StopSignal, syscall.SIGTERM); err != nil {
+		report("Emulator %q: stop_signal invalid: %v", id, err)
+	}
+	if toDuration(req.StopGracePeriod, 0) < 0 {
+		report("Emulator %q: stop_grace_period is negative", id)
+	}
+	if req.Rule != nil {
+		if req.Rule.RuleId == "" {
+			report("Emulator %q: rule.rule_id was not specified", id)
+		}
+		if err := s.checkTargetPatterns(req.Rule.TargetPatterns); err != nil {
+			report("Emulator %q: rule.target_patterns invalid: %v", id, err)
+		}
+		if err := checkPathRewrite(req.Rule.PathRewrite); err != nil {
+			report("Emulator %q: rule.path_rewrite invalid: %v", id, err)
+		}
+	}
+	if err := checkDependencies(req); err != nil {
+		report("Emulator %q: depends_on invalid: %v", id, err)
+	}
+	return problems
+}
+
+// Adds an emulator with the given spec, and its rule. The emulator is OFFLINE.
+// REQUIRES s.mu.Lock().
+func (s *server) addEmulator(req *emulators.Emulator, log *emulatorLog) {
+	id := req.EmulatorId
+	emu := localEmulator{
+		emulator: proto.Clone(req).(*emulators.Emulator),
+		spec:     proto.Clone(req).(*emulators.Emulator),
+		expander: s.expander.newScope(id),
+		onLaunch: s.handleEmulatorLaunch,
+		onExit:   s.handleEmulatorExit,
+		onChange: s.publishEvent,
+		log:      log}
 	emu.emulator.State = emulators.Emulator_OFFLINE
+	emu.emulator.LastExit = nil
+	emu.emulator.RestartCount = 0
+	emu.emulator.Health = nil
+	emu.emulator.Ports = nil
+	if portMatcher.MatchString(emu.emulator.Rule.ResolvedHost) {
+		// The broker sets the resolved host when it starts the emulator.
+		emu.resolvedHostTemplate = emu.emulator.Rule.ResolvedHost
+		emu.emulator.Rule.ResolvedHost = ""
+	}
 	s.emulators[id] = &emu
-	s.resolveRules[ruleId] = emu.emulator.Rule // shared
-	return EmptyPb, nil
+	s.resolveRules[req.Rule.RuleId] = emu.emulator.Rule // shared
+	s.ruleIndex.rebuild(s.resolveRules)
 }
 
 // Finds a spec, by id. Returns NOT_FOUND if the spec doesn't exist.
@@ -291,7 +779,8 @@ func (s *server) GetEmulator(ctx context.Context, req *emulators.EmulatorId) (*e
 	if !exists {
 		return nil, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
 	}
-	return emu.Emulator(), nil
+	// A copy, since the emulator changes after the lock is released.
+	return proto.Clone(emu.emulator).(*emulators.Emulator), nil
 }
 
 // Lists all specs.
@@ -300,13 +789,241 @@ func (s *server) ListEmulators(ctx context.Context, _ *pb.Empty) (*emulators.Lis
 	defer s.mu.Unlock()
 	var l []*emulators.Emulator
 	for _, emu := range s.emulators {
-		l = append(l, emu.Emulator())
+		l = append(l, proto.Clone(emu.emulator).(*emulators.Emulator))
 	}
 	return &emulators.ListEmulatorsResponse{Emulators: l}, nil
 }
 
-func outputLogPrefixer(prefix string, in io.Reader) {
+// Handles the launch of an emulator process. If the emulator has a readiness
+// check, starts polling it.
+// REQUIRES s.mu.Lock().
+func (s *server) handleEmulatorLaunch(emu *localEmulator, cmd *exec.Cmd) {
+	id := emu.emulator.EmulatorId
+	check := emu.emulator.ReadinessCheck
+	if check == nil {
+		// The emulator reports itself online.
+		return
+	}
+	resolvedHost := check.ResolvedHost
+	if resolvedHost == "" {
+		resolvedHost = emu.resolvedHostTemplate
+	}
+	err := emu.expander.expandSpecialTokens(&resolvedHost)
+	if err != nil {
+		glog.Warningf("Emulator %q: failed to expand readiness_check.resolved_host: %v", id, err)
+		return
+	}
+	probe, err := newProber(check.Probe, resolvedHost, func(t string) (string, error) {
+		err := emu.expander.expandSpecialTokens(&t)
+		return t, err
+	})
+	if err != nil {
+		glog.Warningf("Emulator %q: failed to create readiness probe: %v", id, err)
+		return
+	}
+	go s.awaitReadiness(emu, cmd, probe, toDuration(check.Period, defaultReadinessCheckPeriod), resolvedHost)
+}
+
+// Polls the probe until it succeeds, then reports the emulator ONLINE with the
+// given resolved host. Stops polling if the process launched with cmd is no
+// longer STARTING, e.g. the emulator reported itself online, or was stopped.
+func (s *server) awaitReadiness(emu *localEmulator, cmd *exec.Cmd, probe prober, period time.Duration, resolvedHost string) {
+	id := emu.emulator.EmulatorId
+	starting := func() bool {
+		return emu.cmd == cmd && emu.State() == emulators.Emulator_STARTING
+	}
+	for {
+		s.mu.Lock()
+		ok := starting()
+		s.mu.Unlock()
+		if !ok {
+			glog.V(1).Infof("Emulator %q no longer starting; readiness check stopped", id)
+			return
+		}
+		err := probe()
+		if err == nil {
+			break
+		}
+		glog.V(2).Infof("Emulator %q not ready: %v", id, err)
+		time.Sleep(period)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !starting() {
+		return
+	}
+	emu.markOnline()
+	emu.setResolvedHost(resolvedHost)
+	glog.Infof("Emulator %q passed its readiness check, resolved host: %s", id, resolvedHost)
+	s.startLivenessCheck(emu)
+}
+
+// Starts checking the liveness of an emulator that just became ONLINE, if it
+// has a liveness check.
+// REQUIRES s.mu.Lock().
+func (s *server) startLivenessCheck(emu *localEmulator) {
+	check := emu.emulator.LivenessCheck
+	if check == nil || emu.cmd == nil {
+		return
+	}
+	resolvedHost := emu.emulator.Rule.ResolvedHost
+	probe, err := newProber(check.Probe, resolvedHost, func(t string) (string, error) {
+		err := emu.expander.expandSpecialTokens(&t)
+		return t, err
+	})
+	if err != nil {
+		glog.Warningf("Emulator %q: failed to create liveness probe: %v", emu.emulator.EmulatorId, err)
+		return
+	}
+	emu.emulator.Health = &emulators.HealthStatus{}
+	go s.checkLiveness(emu, emu.cmd, probe, resolvedHost)
+}
+
+// Periodically runs the probe while the process launched with cmd is ONLINE,
+// and updates the health of the emulator with the results. After too many
+// consecutive failures, the emulator becomes UNHEALTHY, and its resolved host
+// is retracted until the probe succeeds again. If the emulator is restarted
+// when unhealthy, it is stopped, and the check ends once its process tree has
+// exited. The restarted process is checked once it is ONLINE again.
+func (s *server) checkLiveness(emu *localEmulator, cmd *exec.Cmd, probe prober, resolvedHost string) {
+	id := emu.emulator.EmulatorId
+	check := emu.emulator.LivenessCheck
+	period := toDuration(check.Period, defaultLivenessCheckPeriod)
+	threshold := check.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultLivenessFailureThreshold
+	}
+	online := func() bool {
+		return emu.cmd == cmd && emu.State() == emulators.Emulator_ONLINE
+	}
+	for {
+		time.Sleep(period)
+		s.mu.Lock()
+		ok := online()
+		s.mu.Unlock()
+		if !ok {
+			glog.V(1).Infof("Emulator %q no longer online; liveness check stopped", id)
+			return
+		}
+		err := probe()
+
+		s.mu.Lock()
+		if !online() {
+			s.mu.Unlock()
+			return
+		}
+		health := emu.emulator.Health
+		if err == nil {
+			if health.Status == emulators.HealthStatus_UNHEALTHY {
+				glog.Infof("Emulator %q is healthy again", id)
+				emu.setResolvedHost(resolvedHost)
+			}
+			health.Status = emulators.HealthStatus_HEALTHY
+			health.ConsecutiveFailures = 0
+		} else {
+			glog.V(1).Infof("Emulator %q failed liveness check: %v", id, err)
+			health.ConsecutiveFailures++
+			health.LastFailure = err.Error()
+			if health.Status != emulators.HealthStatus_UNHEALTHY && health.ConsecutiveFailures >= threshold {
+				glog.Warningf("Emulator %q is unhealthy after %d failed checks: %v", id, health.ConsecutiveFailures, err)
+				health.Status = emulators.HealthStatus_UNHEALTHY
+				emu.setResolvedHost("")
+				if check.RestartWhenUnhealthy {
+					// The exit handler restarts the emulator. It is stopped like
+					// StopEmulator() does, and killed if it doesn't exit in time.
+					emu.restartOnExit = true
+					sig, _ := parseStopSignal(emu.emulator.StopSignal, syscall.SIGTERM)
+					grace := toDuration(emu.emulator.StopGracePeriod, defaultStopGracePeriod)
+					exited := emu.exited
+					if err := signalProcessTree(cmd, sig); err != nil {
+						glog.Warningf("Failed to signal unhealthy emulator %q: %v", id, err)
+					}
+					s.mu.Unlock()
+					if err := awaitProcessTreeExit(cmd, exited, grace); err != nil {
+						glog.Warningf("Failed to stop unhealthy emulator %q: %v", id, err)
+					}
+					return
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Handles the exit of an emulator process. If the process exited without being
+// stopped by the broker, the emulator becomes CRASHED, and its resolved host is
+// retracted.
+func (s *server) handleEmulatorExit(emu *localEmulator, cmd *exec.Cmd, state *os.ProcessState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := emu.emulator.EmulatorId
+	if emu.cmd != cmd {
+		// The emulator has already been restarted with a new process.
+		glog.V(1).Infof("Previous process of emulator %q exited", id)
+		return
+	}
+	emu.emulator.LastExit = processExit(state)
+	emu.notify(emulators.EmulatorEvent_EXITED, emu.emulator.State)
+	if !emu.running() {
+		glog.V(1).Infof("Emulator %q exited after being stopped: %v", id, emu.emulator.LastExit)
+		return
+	}
+	glog.Warningf("Emulator %q exited unexpectedly while %s: %v", id, emu.emulator.State, emu.emulator.LastExit)
+	emu.setResolvedHost("")
+	emu.emulator.Health = nil
+	s.restartOrCrash(emu)
+}
+
+// Schedules a restart of an emulator whose process exited or could not be
+// launched, after a backoff, if its restart policy allows it. Otherwise, the
+// emulator becomes CRASHED.
+// REQUIRES s.mu.Lock().
+func (s *server) restartOrCrash(emu *localEmulator) {
+	id := emu.emulator.EmulatorId
+	restart := emu.shouldRestart(emu.emulator.LastExit) || (emu.restartOnExit && !emu.retriesExhausted())
+	if !restart {
+		emu.setState(emulators.Emulator_CRASHED)
+		emu.releasePorts()
+		return
+	}
+	// The emulator remains STARTING until it is restarted.
+	delay := emu.restartBackoff()
+	emu.emulator.RestartCount++
+	emu.setState(emulators.Emulator_STARTING)
+	emu.cmd = nil
+	glog.Infof("Restarting emulator %q in %v (restart #%d)", id, delay, emu.emulator.RestartCount)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		s.restartEmulator(emu, timer)
+	})
+	emu.restartTimer = timer
+}
+
+// Relaunches an emulator whose restart was scheduled with timer. Does nothing
+// if the restart was cancelled, e.g. the emulator was stopped or deleted.
+func (s *server) restartEmulator(emu *localEmulator, timer *time.Timer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if emu.restartTimer != timer {
+		return
+	}
+	emu.restartTimer = nil
+	err := emu.launch()
+	if err != nil {
+		glog.Warningf("Failed to restart emulator %q: %v", emu.emulator.EmulatorId, err)
+		// Counts as a failed exit, so the restart policy applies.
+		emu.emulator.LastExit = processExit(nil)
+		s.restartOrCrash(emu)
+	}
+}
+
+// Copies lines from in to stderr, each prefixed with prefix, and closes in at
+// the end of the stream. Lines are also written to log as coming from stream,
+// if log is not nil.
+func outputLogPrefixer(prefix string, in io.ReadCloser, log *emulatorLog, stream emulators.LogLine_Stream) {
 	glog.V(1).Infof("Output connected for %q", prefix)
+	defer in.Close()
 	buffReader := bufio.NewReader(in)
 	for {
 		line, _, err := buffReader.ReadLine()
@@ -315,6 +1032,9 @@ func outputLogPrefixer(prefix string, in io.Reader) {
 			return
 		}
 		fmt.Fprintf(os.Stderr, "%s: %s\n", prefix, line)
+		if log != nil {
+			log.write(stream, string(line))
+		}
 	}
 }
 
@@ -330,27 +1050,74 @@ func (s *server) startDeadline(ctx context.Context) time.Time {
 	return deadline
 }
 
-func (s *server) StartEmulator(ctx context.Context, req *emulators.EmulatorId) (*pb.Empty, error) {
+func (s *server) StartEmulator(ctx context.Context, req *emulators.EmulatorId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "StartEmulator", req.EmulatorId, &err)
 	id := req.EmulatorId
 	glog.V(1).Infof("StartEmulator %v.", id)
+	_, err = s.startWithDependencies(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return EmptyPb, nil
+}
+
+// Starts the dependencies of the emulator, and then the emulator. Returns the
+// emulators that this call launched, and that are serving, in the order they
+// were started, even if it fails. See StartEmulator().
+func (s *server) startWithDependencies(ctx context.Context, id string) ([]string, error) {
+	s.mu.Lock()
+	order, err := s.startOrder(id)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var launched []string
+	// Start the dependencies first, one at a time, since each may depend on
+	// the previous ones.
+	for _, dep := range order[:len(order)-1] {
+		l, err := s.startEmulator(ctx, dep)
+		if err != nil && grpc.Code(err) != codes.AlreadyExists {
+			return launched, grpc.Errorf(grpc.Code(err), "Emulator %q: dependency %q could not be started: %v", id, dep, grpc.ErrorDesc(err))
+		}
+		if l {
+			launched = append(launched, dep)
+		}
+	}
+	l, err := s.startEmulator(ctx, id)
+	if err != nil {
+		return launched, err
+	}
+	if l {
+		launched = append(launched, id)
+	}
+	return launched, nil
+}
+
+// Starts the emulator, without starting its dependencies, and waits until it
+// is serving. Returns whether this call launched it, rather than waiting for
+// another call to. See StartEmulator().
+func (s *server) startEmulator(ctx context.Context, id string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	emu, exists := s.emulators[id]
 	if !exists {
-		return nil, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
+		return false, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
 	}
 	if emu.State() == emulators.Emulator_ONLINE {
-		return nil, grpc.Errorf(codes.AlreadyExists, "Emulator %q is already running.", id)
+		return false, grpc.Errorf(codes.AlreadyExists, "Emulator %q is already running.", id)
+	}
+	if emu.State() == emulators.Emulator_STOPPING {
+		return false, grpc.Errorf(codes.FailedPrecondition, "Emulator %q is stopping.", id)
 	}
 	killOnFailure := false
-	if emu.State() == emulators.Emulator_OFFLINE {
+	if !emu.running() {
 		// A single execution context should transition the emulator to STARTING.
 		// Other contexts should wait for the start to complete.
 		err := emu.start()
 		if err != nil {
-			emu.kill()
-			return nil, grpc.Errorf(codes.Unknown, "Emulator %q could not be started: %v", id, err)
+			s.stopEmulator(emu)
+			return false, grpc.Errorf(codes.Unknown, "Emulator %q could not be started: %v", id, err)
 		}
 		killOnFailure = true
 	}
@@ -360,30 +1127,34 @@ func (s *server) StartEmulator(ctx context.Context, req *emulators.EmulatorId) (
 	// We avoid holding the lock while waiting for the emulator to start serving.
 	// We don't touch the emulator instance when not holding the lock.
 	s.mu.Unlock()
-	started := make(chan bool, 1)
+	started := make(chan error, 1)
 	go func() {
 		_, err2 := s.waitForResolvedHost(ruleId, s.startDeadline(ctx))
-		started <- (err2 == nil)
+		started <- err2
 	}()
-	ok := <-started
+	err := <-started
 
 	s.mu.Lock()
-	if !ok {
+	if err != nil {
+		if grpc.Code(err) == codes.Aborted {
+			return false, err
+		}
 		if killOnFailure {
 			// Only the execution context that started the emulator should kill it.
-			emu.kill()
+			s.stopEmulator(emu)
 		}
-		return nil, grpc.Errorf(codes.DeadlineExceeded, "Timed-out waiting for emulator %q to start serving", id)
+		return false, grpc.Errorf(codes.DeadlineExceeded, "Timed-out waiting for emulator %q to start serving", id)
 	}
 
 	glog.V(1).Infof("Emulator %q started and serving", id)
-	return EmptyPb, nil
+	return killOnFailure, nil
 }
 
-func (s *server) ReportEmulatorOnline(ctx context.Context, req *emulators.ReportEmulatorOnlineRequest) (*pb.Empty, error) {
+func (s *server) ReportEmulatorOnline(ctx context.Context, req *emulators.ReportEmulatorOnlineRequest) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "ReportEmulatorOnline", req.EmulatorId, &err)
 	id := req.EmulatorId
 	glog.V(1).Infof("ReportEmulatorOnline %v.", id)
-	err := s.checkTargetPatterns(req.TargetPatterns)
+	err = s.checkTargetPatterns(req.TargetPatterns)
 	if err != nil {
 		return nil, grpc.Errorf(codes.InvalidArgument, "target_patterns invalid: %v", err)
 	}
@@ -403,13 +1174,28 @@ func (s *server) ReportEmulatorOnline(ctx context.Context, req *emulators.Report
 	}
 	rule := emu.Emulator().Rule
 	rule.TargetPatterns = merge(rule.TargetPatterns, req.TargetPatterns)
-	rule.ResolvedHost = req.ResolvedHost
+	s.ruleIndex.rebuild(s.resolveRules)
+	emu.setResolvedHost(req.ResolvedHost)
+	s.startLivenessCheck(emu)
 	return EmptyPb, nil
 }
 
-func (s *server) StopEmulator(ctx context.Context, req *emulators.EmulatorId) (*pb.Empty, error) {
-	id := req.EmulatorId
-	glog.V(1).Infof("StopEmulator %v.", id)
+func (s *server) StopEmulator(ctx context.Context, req *emulators.EmulatorId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "StopEmulator", req.EmulatorId, &err)
+	glog.V(1).Infof("StopEmulator %v.", req.EmulatorId)
+	return s.stopEmulatorWithDependents(req.EmulatorId, false)
+}
+
+func (s *server) StopEmulatorCascade(ctx context.Context, req *emulators.EmulatorId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "StopEmulatorCascade", req.EmulatorId, &err)
+	glog.V(1).Infof("StopEmulatorCascade %v.", req.EmulatorId)
+	return s.stopEmulatorWithDependents(req.EmulatorId, true)
+}
+
+// Stops the emulator, after stopping the running emulators that depend on it
+// if cascade is true. Returns FAILED_PRECONDITION if running emulators depend
+// on it otherwise.
+func (s *server) stopEmulatorWithDependents(id string, cascade bool) (*pb.Empty, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -417,27 +1203,138 @@ func (s *server) StopEmulator(ctx context.Context, req *emulators.EmulatorId) (*
 	if !exists {
 		return nil, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
 	}
+	dependents := s.runningDependents(id)
+	if len(dependents) > 0 && !cascade {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Emulator %q is required by running emulators %q.", id, dependents)
+	}
+	for _, dependentId := range dependents {
+		dependent, exists := s.emulators[dependentId]
+		if !exists {
+			// Deleted concurrently, while the lock was released.
+			continue
+		}
+		dependent.setResolvedHost("")
+		if err := s.stopEmulator(dependent); err != nil {
+			return nil, grpc.Errorf(codes.Internal, "Emulator %q: dependent %q could not be stopped: %v", id, dependentId, err)
+		}
+	}
 	// Retract the ResolvedHost.
-	emu.Emulator().Rule.ResolvedHost = ""
-	if err := emu.kill(); err != nil {
-		return nil, err
+	emu.setResolvedHost("")
+	if err := s.stopEmulator(emu); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Emulator %q could not be stopped: %v", id, err)
 	}
 	return EmptyPb, nil
 }
 
-func (s *server) CreateResolveRule(ctx context.Context, req *emulators.ResolveRule) (*pb.Empty, error) {
-	glog.V(1).Infof("Create ResolveRule %q", req)
-	if req.RuleId == "" {
-		return nil, grpc.Errorf(codes.InvalidArgument, "rule.rule_id was not specified")
+func (s *server) GetEmulatorLogs(req *emulators.GetEmulatorLogsRequest, stream emulators.Broker_GetEmulatorLogsServer) error {
+	id := req.EmulatorId
+	glog.V(1).Infof("GetEmulatorLogs %v.", id)
+	s.mu.Lock()
+	emu, exists := s.emulators[id]
+	s.mu.Unlock()
+	if !exists {
+		return grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
 	}
-	if !idMatcher.MatchString(req.RuleId) {
-		return nil, grpc.Errorf(codes.InvalidArgument, "rule.rule_id contains invalid characters")
+	since := fromTimestamp(req.Since)
+	lines, next, updated := emu.log.read(0)
+	lines = filterLogLines(lines, int(req.Tail), since)
+	for {
+		for _, line := range lines {
+			if err := stream.Send(line); err != nil {
+				return err
+			}
+		}
+		if !req.Follow || updated == nil {
+			// Not following, or the emulator was deleted.
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+		lines, next, updated = emu.log.read(next)
+		lines = filterLogLines(lines, 0, since)
 	}
-	id := req.RuleId
-	err := s.checkTargetPatterns(req.TargetPatterns)
-	if err != nil {
-		return nil, grpc.Errorf(codes.InvalidArgument, "Resolve rule %q: target_patterns invalid: %v", id, err)
+}
+
+func (s *server) WatchEmulators(req *emulators.WatchEmulatorsRequest, stream emulators.Broker_WatchEmulatorsServer) error {
+	glog.V(1).Infof("WatchEmulators %v.", req)
+	w := newEmulatorWatcher(req.EmulatorId)
+	s.mu.Lock()
+	if _, exists := s.emulators[req.EmulatorId]; req.EmulatorId != "" && !exists {
+		s.mu.Unlock()
+		return grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", req.EmulatorId)
+	}
+	s.watchers[w] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-w.updated:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+		s.mu.Lock()
+		events, overflowed := w.take()
+		s.mu.Unlock()
+		for _, event := range events {
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+		if overflowed {
+			return grpc.Errorf(codes.ResourceExhausted, "Watcher fell behind by more than %d events, and missed events.", maxWatcherEvents)
+		}
 	}
+}
+
+func (s *server) DeleteEmulator(ctx context.Context, req *emulators.EmulatorId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "DeleteEmulator", req.EmulatorId, &err)
+	id := req.EmulatorId
+	glog.V(1).Infof("DeleteEmulator %v.", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emu, exists := s.emulators[id]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Emulator %q doesn't exist.", id)
+	}
+	if dependents := s.directDependents(id); len(dependents) > 0 {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Emulator %q is required by emulators %q.", id, dependents)
+	}
+	// Retract the ResolvedHost, in case the rule is still referenced elsewhere.
+	emu.setResolvedHost("")
+	if err := s.stopEmulator(emu); err != nil {
+		return nil, grpc.Errorf(codes.Internal, "Emulator %q could not be stopped: %v", id, err)
+	}
+	if s.emulators[id] != emu {
+		// Deleted concurrently, while the lock was released.
+		return EmptyPb, nil
+	}
+	if p, exists := s.proxies[id]; exists {
+		s.closeProxy(p)
+		delete(s.proxies, id)
+	}
+	delete(s.resolveRules, emu.Emulator().Rule.RuleId)
+	s.ruleIndex.rebuild(s.resolveRules)
+	delete(s.emulators, id)
+	emu.log.close()
+	return EmptyPb, nil
+}
+
+func (s *server) CreateResolveRule(ctx context.Context, req *emulators.ResolveRule) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "CreateResolveRule", req.RuleId, &err)
+	glog.V(1).Infof("Create ResolveRule %q", req)
+	if err := s.checkResolveRule(req); err != nil {
+		return nil, err
+	}
+	id := req.RuleId
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	rule, exists := s.resolveRules[id]
@@ -450,9 +1347,28 @@ func (s *server) CreateResolveRule(ctx context.Context, req *emulators.ResolveRu
 		return nil, grpc.Errorf(codes.AlreadyExists, "Resolve rule %q already exists exist.", id)
 	}
 	s.resolveRules[id] = proto.Clone(req).(*emulators.ResolveRule)
+	s.ruleIndex.rebuild(s.resolveRules)
 	return EmptyPb, nil
 }
 
+// Checks whether the rule is valid. Returns INVALID_ARGUMENT if it is not.
+func (s *server) checkResolveRule(req *emulators.ResolveRule) error {
+	if req.RuleId == "" {
+		return grpc.Errorf(codes.InvalidArgument, "rule.rule_id was not specified")
+	}
+	if !idMatcher.MatchString(req.RuleId) {
+		return grpc.Errorf(codes.InvalidArgument, "rule.rule_id contains invalid characters")
+	}
+	id := req.RuleId
+	if err := s.checkTargetPatterns(req.TargetPatterns); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Resolve rule %q: target_patterns invalid: %v", id, err)
+	}
+	if err := checkPathRewrite(req.PathRewrite); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Resolve rule %q: path_rewrite invalid: %v", id, err)
+	}
+	return nil
+}
+
 func (s *server) GetResolveRule(ctx context.Context, req *emulators.ResolveRuleId) (*emulators.ResolveRule, error) {
 	glog.V(1).Infof("Get ResolveRule %q", req)
 	s.mu.Lock()
@@ -461,20 +1377,36 @@ func (s *server) GetResolveRule(ctx context.Context, req *emulators.ResolveRuleI
 	if !exists {
 		return nil, grpc.Errorf(codes.NotFound, "Resolve rule %q doesn't exist.", req.RuleId)
 	}
-	return rule, nil
+	// A copy, since the rule of an emulator changes after the lock is released.
+	return proto.Clone(rule).(*emulators.ResolveRule), nil
 }
 
-func (s *server) UpdateResolveRule(ctx context.Context, req *emulators.ResolveRule) (*emulators.ResolveRule, error) {
+func (s *server) UpdateResolveRule(ctx context.Context, req *emulators.ResolveRule) (_ *emulators.ResolveRule, err error) {
+	defer s.recordEvent(ctx, "UpdateResolveRule", req.RuleId, &err)
 	glog.V(1).Infof("Update ResolveRule %q", req)
+	if err := s.checkResolveRule(req); err != nil {
+		return nil, err
+	}
+	id := req.RuleId
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	rule, exists := s.resolveRules[req.RuleId]
+	rule, exists := s.resolveRules[id]
 	if !exists {
-		return nil, grpc.Errorf(codes.NotFound, "Resolve rule %q doesn't exist.", req.RuleId)
+		return nil, grpc.Errorf(codes.NotFound, "Resolve rule %q doesn't exist.", id)
 	}
-	rule.TargetPatterns = merge(rule.TargetPatterns, req.TargetPatterns)
-	rule.ResolvedHost = req.ResolvedHost
-	return rule, nil
+	updated := proto.Clone(req).(*emulators.ResolveRule)
+	updated.TargetPatterns = merge(rule.TargetPatterns, req.TargetPatterns)
+	if emu := s.findLocalEmulator(id); emu != nil {
+		// The emulator shares its rule, and reports the new resolved host.
+		updated.ResolvedHost = rule.ResolvedHost
+		emu.emulator.Rule = updated
+		s.resolveRules[id] = updated
+		emu.setResolvedHost(req.ResolvedHost)
+	} else {
+		s.resolveRules[id] = updated
+	}
+	s.ruleIndex.rebuild(s.resolveRules)
+	return proto.Clone(updated).(*emulators.ResolveRule), nil
 }
 
 func (s *server) ListResolveRules(ctx context.Context, req *pb.Empty) (*emulators.ListResolveRulesResponse, error) {
@@ -483,55 +1415,156 @@ func (s *server) ListResolveRules(ctx context.Context, req *pb.Empty) (*emulator
 	defer s.mu.Unlock()
 	resp := &emulators.ListResolveRulesResponse{}
 	for _, rule := range s.resolveRules {
-		resp.Rules = append(resp.Rules, rule)
+		resp.Rules = append(resp.Rules, proto.Clone(rule).(*emulators.ResolveRule))
 	}
 	return resp, nil
 }
 
+func (s *server) DeleteResolveRule(ctx context.Context, req *emulators.ResolveRuleId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "DeleteResolveRule", req.RuleId, &err)
+	glog.V(1).Infof("Delete ResolveRule %q", req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.resolveRules[req.RuleId]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Resolve rule %q doesn't exist.", req.RuleId)
+	}
+	emu := s.findEmulator(req.RuleId)
+	if emu != nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"Resolve rule %q belongs to emulator %q, and can only be deleted with it.", req.RuleId, emu.EmulatorId)
+	}
+	delete(s.resolveRules, req.RuleId)
+	s.ruleIndex.rebuild(s.resolveRules)
+	return EmptyPb, nil
+}
+
+// Computes the response for a target matched by a rule with a resolved host.
 func computeResolveResponse(target string, rule *emulators.ResolveRule) (*emulators.ResolveResponse, error) {
+	return resolveTarget(target, rule, rule.ResolvedHost)
+}
+
+// Computes the response for a target matched by the rule, replacing the host
+// of the target with resolvedHost. Each form of target documented by
+// ResolveRequest is handled separately.
+func resolveTarget(target string, rule *emulators.ResolveRule, resolvedHost string) (*emulators.ResolveResponse, error) {
+	resp := &emulators.ResolveResponse{RequiresSecureConnection: rule.RequiresSecureConnection}
+	resp.Host, resp.Port = splitResolvedHost(resolvedHost)
+	if serviceMethodMatcher.MatchString(target) {
+		// The target to dial is the resolved host, and the method is only
+		// returned as the path.
+		resp.Target = resolvedHost
+		resp.Path = target
+		return resp, nil
+	}
+	if hostPortMatcher.MatchString(target) {
+		resp.Target = resolvedHost
+		return resp, nil
+	}
 	url, err := url.Parse(target)
-	if err == nil && url.Scheme != "" {
-		url.Host = rule.ResolvedHost
-		if rule.RequiresSecureConnection {
-			url.Scheme = "https"
-		} else {
-			url.Scheme = "http"
+	if err != nil || url.Scheme == "" {
+		// Not a documented form. The whole target is replaced.
+		resp.Target = resolvedHost
+		return resp, nil
+	}
+	url.Scheme = resolveScheme(url.Scheme, rule)
+	switch {
+	case url.Opaque != "":
+		// E.g. "dns:host:port".
+		url.Opaque = resolvedHost
+	case url.Scheme == "dns" || url.Host == "":
+		// E.g. "dns://authority/host:port", or "dns:///host:port". The endpoint
+		// is the path. The DNS authority doesn't apply to the resolved host.
+		url.Host = ""
+		url.Path = "/" + resolvedHost
+	default:
+		url.Host = resolvedHost
+		if path := rewritePath(url.Path, rule.PathRewrite); path != url.Path {
+			url.Path = path
+			url.RawPath = ""
 		}
-		return &emulators.ResolveResponse{Target: url.String(), RequiresSecureConnection: rule.RequiresSecureConnection}, nil
+		resp.Path = url.Path
 	}
-	return &emulators.ResolveResponse{Target: rule.ResolvedHost, RequiresSecureConnection: rule.RequiresSecureConnection}, nil
+	resp.Target = url.String()
+	resp.Scheme = url.Scheme
+	return resp, nil
 }
 
 // Resolves a target according to relevant specs. If no spec apply, the input
 // target is returned in the response.
 func (s *server) Resolve(ctx context.Context, req *emulators.ResolveRequest) (*emulators.ResolveResponse, error) {
 	glog.V(1).Infof("Resolve %q", req.Target)
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := s.ruleIndex.match(req.Target)
+	if len(matches) == 0 {
+		return &emulators.ResolveResponse{Target: req.Target}, nil
+	}
+	if ids := ambiguousRules(matches); ids != nil {
+		if s.rejectAmbiguousMatches {
+			return nil, grpc.Errorf(codes.FailedPrecondition, "Target %q matches rules %q equally well.", req.Target, ids)
+		}
+		glog.Warningf("Target %q matches rules %q equally well, using %q", req.Target, ids, ids[0])
+	}
+	resp, err := s.resolveWithRule(ctx, req.Target, matches[0])
+	if err != nil {
+		return nil, err
+	}
+	if req.Explain {
+		resp.Candidates = resolveCandidates(matches)
+	}
+	return resp, nil
+}
 
-	// Find the matching rule.
-	var rule *emulators.ResolveRule = nil
-	for _, r := range s.resolveRules {
-		for _, regexp := range r.TargetPatterns {
-			matched, err := re.MatchString(regexp, req.Target)
+// The maximum number of targets of a BatchResolve() call that are resolved
+// at a time.
+const maxBatchResolveParallelism = 8
+
+func (s *server) BatchResolve(ctx context.Context, req *emulators.BatchResolveRequest) (*emulators.BatchResolveResponse, error) {
+	glog.V(1).Infof("BatchResolve %d targets", len(req.Requests))
+	// Resolve the targets in parallel, so that emulators are started in
+	// parallel, but only a few at a time.
+	results := make([]*emulators.BatchResolveResult, len(req.Requests))
+	slots := make(chan bool, maxBatchResolveParallelism)
+	var wg sync.WaitGroup
+	for i, r := range req.Requests {
+		wg.Add(1)
+		slots <- true
+		go func(i int, r *emulators.ResolveRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			resp, err := s.Resolve(ctx, r)
 			if err != nil {
-				// This is unexpected, since we should have rejected bad expressions
-				// when the rule was being created. We log and move on.
-				glog.Warningf("Encountered invalid target pattern: %s", regexp)
-				continue
-			}
-			if matched {
-				rule = r
-				break
+				results[i] = &emulators.BatchResolveResult{Code: grpc.Code(err).String(), Error: grpc.ErrorDesc(err)}
+				if results[i].Error == "" {
+					results[i].Error = results[i].Code
+				}
+				return
 			}
-		}
+			results[i] = &emulators.BatchResolveResult{Response: resp, Code: codes.OK.String()}
+		}(i, r)
 	}
-	if rule == nil {
-		return &emulators.ResolveResponse{Target: req.Target}, nil
+	wg.Wait()
+	return &emulators.BatchResolveResponse{Results: results}, nil
+}
+
+// Resolves the target with the matching rule, starting the rule's emulator if
+// needed.
+// REQUIRES s.mu.RLock(), which is released while the emulator starts.
+func (s *server) resolveWithRule(ctx context.Context, target string, m *ruleMatch) (*emulators.ResolveResponse, error) {
+	rule := m.rule
+	if rule.ResolvedTargetTemplate != "" {
+		host := m.expand(rule.ResolvedTargetTemplate, target)
+		if host == "" {
+			return nil, grpc.Errorf(codes.Unavailable, "Rule %q has no resolved host (resolved_target_template expands to nothing)", rule.RuleId)
+		}
+		glog.V(1).Infof("Matched to %q", host)
+		return resolveTarget(target, rule, host)
 	}
 	if rule.ResolvedHost != "" {
 		glog.V(1).Infof("Matched to %q", rule.ResolvedHost)
-		return computeResolveResponse(req.Target, rule)
+		return computeResolveResponse(target, rule)
 	}
 
 	// The rule does not specify a resolved host. If it is associated with an
@@ -545,9 +1578,9 @@ func (s *server) Resolve(ctx context.Context, req *emulators.ResolveRequest) (*e
 			"Rule %q has no resolved host (emulator not running and not started on demand)", rule.RuleId)
 	}
 
-	s.mu.Unlock()
+	s.mu.RUnlock()
 	_, err := s.StartEmulator(ctx, &emulators.EmulatorId{EmulatorId: emu.EmulatorId})
-	s.mu.Lock()
+	s.mu.RLock()
 
 	if err != nil {
 		return nil, grpc.Errorf(codes.Unavailable, "Rule %q has no resolved host (emulator failed to start): %v", rule.RuleId, err)
@@ -556,20 +1589,30 @@ func (s *server) Resolve(ctx context.Context, req *emulators.ResolveRequest) (*e
 		return nil, grpc.Errorf(codes.Unavailable, "Rule %q has no resolved host (retry?)", rule.RuleId)
 	}
 	glog.V(1).Infof("Matched to %q", rule.ResolvedHost)
-	return computeResolveResponse(req.Target, rule)
+	return computeResolveResponse(target, rule)
 }
 
-// REQUIRES s.mu.Lock().
+// REQUIRES s.mu.RLock().
 func (s *server) findEmulator(ruleId string) *emulators.Emulator {
+	if emu := s.findLocalEmulator(ruleId); emu != nil {
+		return emu.Emulator()
+	}
+	return nil
+}
+
+// Returns the emulator whose rule has the given id, or nil.
+func (s *server) findLocalEmulator(ruleId string) *localEmulator {
 	for _, emu := range s.emulators {
 		if emu.Emulator().Rule.RuleId == ruleId {
-			return emu.Emulator()
+			return emu
 		}
 	}
 	return nil
 }
 
-func (s *server) CreateProxy(ctx context.Context, req *emulators.Proxy) (*emulators.Proxy, error) {
+func (s *server) CreateProxy(ctx context.Context, req *emulators.Proxy) (_ *emulators.Proxy, err error) {
+	defer s.recordEvent(ctx, "CreateProxy", req.EmulatorId, &err)
+	glog.V(1).Infof("CreateProxy %v.", req)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	_, exists := s.emulators[req.EmulatorId]
@@ -580,15 +1623,60 @@ func (s *server) CreateProxy(ctx context.Context, req *emulators.Proxy) (*emulat
 	if exists {
 		return nil, grpc.Errorf(codes.AlreadyExists, "Proxy %q already exists.", req.EmulatorId)
 	}
-	if req.Port == 0 {
-		port, err := s.expander.portPicker.Next()
+	emulatorId := req.EmulatorId
+	port := req.Port
+	if port == 0 {
+		picked, err := s.expander.allocator.allocate(emulators.PortAllocation_PROXY, emulatorId, "")
 		if err != nil {
 			return nil, grpc.Errorf(codes.ResourceExhausted, "Failed to pick a proxy port: %v", err)
 		}
-		req.Port = int32(port)
+		port = int32(picked)
+	}
+	p := newLocalProxy(&emulators.Proxy{EmulatorId: emulatorId, Port: port}, func() (string, error) {
+		return s.proxyTarget(emulatorId)
+	})
+	err = p.start()
+	if err != nil {
+		s.expander.allocator.releaseOwner(emulators.PortAllocation_PROXY, emulatorId)
+		return nil, grpc.Errorf(codes.Unavailable, "Proxy port %d is not available: %v", port, err)
 	}
-	s.proxies[req.EmulatorId] = &localProxy{proxy: &emulators.Proxy{EmulatorId: req.EmulatorId, Port: req.Port}}
-	return s.proxies[req.EmulatorId].proxy, nil
+	s.proxies[emulatorId] = p
+	return p.proxy, nil
+}
+
+// Returns the resolved host that the proxy for the given emulator should
+// forward to. If the emulator is not running and starts on demand, it is
+// started. Returns UNAVAILABLE if there is no resolved host.
+func (s *server) proxyTarget(emulatorId string) (string, error) {
+	s.mu.Lock()
+	emu, exists := s.emulators[emulatorId]
+	if !exists {
+		s.mu.Unlock()
+		return "", grpc.Errorf(codes.Unavailable, "Emulator %q doesn't exist.", emulatorId)
+	}
+	rule := emu.Emulator().Rule
+	host := rule.ResolvedHost
+	startOnDemand := emu.Emulator().StartOnDemand
+	s.mu.Unlock()
+	if host != "" {
+		return host, nil
+	}
+	if !startOnDemand {
+		return "", grpc.Errorf(codes.Unavailable,
+			"Rule %q has no resolved host (emulator not running and not started on demand)", rule.RuleId)
+	}
+
+	_, err := s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emulatorId})
+	if err != nil && grpc.Code(err) != codes.AlreadyExists {
+		return "", grpc.Errorf(codes.Unavailable, "Rule %q has no resolved host (emulator failed to start): %v", rule.RuleId, err)
+	}
+	s.mu.Lock()
+	host = rule.ResolvedHost
+	s.mu.Unlock()
+	if host == "" {
+		return "", grpc.Errorf(codes.Unavailable, "Rule %q has no resolved host (retry?)", rule.RuleId)
+	}
+	return host, nil
 }
 
 func (s *server) GetProxy(ctx context.Context, req *emulators.EmulatorId) (*emulators.Proxy, error) {
@@ -612,29 +1700,86 @@ func (s *server) ListProxies(ctx context.Context, req *pb.Empty) (*emulators.Lis
 	return &response, nil
 }
 
+func (s *server) DeleteProxy(ctx context.Context, req *emulators.EmulatorId) (_ *pb.Empty, err error) {
+	defer s.recordEvent(ctx, "DeleteProxy", req.EmulatorId, &err)
+	glog.V(1).Infof("DeleteProxy %v.", req.EmulatorId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, exists := s.proxies[req.EmulatorId]
+	if !exists {
+		return nil, grpc.Errorf(codes.NotFound, "Proxy %q doesn't exist.", req.EmulatorId)
+	}
+	s.closeProxy(p)
+	delete(s.proxies, req.EmulatorId)
+	return EmptyPb, nil
+}
+
+// Closes the proxy, and releases its port if it was allocated by the broker.
+func (s *server) closeProxy(p *localProxy) {
+	if err := p.close(); err != nil {
+		glog.Warningf("Error closing proxy %q: %v", p.proxy.EmulatorId, err)
+	}
+	s.expander.allocator.releaseOwner(emulators.PortAllocation_PROXY, p.proxy.EmulatorId)
+}
+
+func (s *server) ListEvents(ctx context.Context, req *emulators.ListEventsRequest) (*emulators.ListEventsResponse, error) {
+	events := s.journal.list(req.ResourceId, fromTimestamp(req.Since), int(req.Tail))
+	return &emulators.ListEventsResponse{Events: events}, nil
+}
+
+func (s *server) ListPortAllocations(ctx context.Context, req *pb.Empty) (*emulators.ListPortAllocationsResponse, error) {
+	return &emulators.ListPortAllocationsResponse{Allocations: s.expander.allocator.list()}, nil
+}
+
 // Waits for the given emulator to enter the STARTING state.
 func (s *server) waitForStarting(emulatorId string, deadline time.Time) error {
-	for time.Now().Before(deadline) {
-		s.mu.Lock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
 		emu, exists := s.emulators[emulatorId]
 		if exists && emu.State() == emulators.Emulator_STARTING {
-			s.mu.Unlock()
 			return nil
 		}
-		s.mu.Unlock()
-		time.Sleep(100 * time.Millisecond)
+		if !s.awaitChange(deadline) {
+			return fmt.Errorf("timed-out waiting for STARTING: %s", emulatorId)
+		}
 	}
-	return fmt.Errorf("timed-out waiting for STARTING: %s", emulatorId)
 }
 
-// Waits for the given spec to have a non-empty resolved host.
+// Waits for the given spec to have a non-empty resolved host. Returns ABORTED
+// if the process of the emulator associated with the spec exits first.
 func (s *server) waitForResolvedHost(ruleId string, deadline time.Time) (*emulators.ResolveRule, error) {
-	for time.Now().Before(deadline) {
-		rule, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: ruleId})
-		if err == nil && rule.ResolvedHost != "" {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		rule, exists := s.resolveRules[ruleId]
+		if exists && rule.ResolvedHost != "" {
 			return rule, nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		emu := s.findEmulator(ruleId)
+		if emu != nil && emu.State == emulators.Emulator_CRASHED {
+			return nil, grpc.Errorf(codes.Aborted, "Emulator %q exited while starting: %v", emu.EmulatorId, emu.LastExit)
+		}
+		if !s.awaitChange(deadline) {
+			return nil, fmt.Errorf("timed-out waiting for resolved host: %s", ruleId)
+		}
+	}
+}
+
+// Waits until an emulator changes, or the deadline passes. Returns false if
+// the deadline passed.
+// REQUIRES s.mu.Lock(), which is released while waiting.
+func (s *server) awaitChange(deadline time.Time) bool {
+	changed := s.changed
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
 	}
-	return nil, fmt.Errorf("timed-out waiting for resolved host: %s", ruleId)
 }
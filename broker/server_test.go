@@ -3,24 +3,32 @@ package broker
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	re "regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	jsonpb "github.com/golang/protobuf/jsonpb"
 	proto "github.com/golang/protobuf/proto"
 	context "golang.org/x/net/context"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	emulators "google/emulators"
 	duration_pb "github.com/golang/protobuf/ptypes/duration"
+	wrappers_pb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 var (
@@ -72,7 +80,8 @@ func TestMain(m *testing.M) {
 }
 
 func setUp() error {
-	tmpDir, err := ioutil.TempDir(os.TempDir(), "server_test")
+	var err error
+	tmpDir, err = ioutil.TempDir(os.TempDir(), "server_test")
 	if err != nil {
 		return fmt.Errorf("Failed to create temp dir: %v", err)
 	}
@@ -126,7 +135,11 @@ func realEmulatorPort(b *grpcServer) (int, error) {
 	if !exists {
 		return 0, fmt.Errorf("Real emulator is not registered with this server.")
 	}
-	return strconv.Atoi(emu.emulator.StartCommand.Args[1][7:])
+	port, exists := emu.emulator.Ports["real"]
+	if !exists {
+		return 0, fmt.Errorf("Real emulator has no port.")
+	}
+	return int(port), nil
 }
 
 func TestExpandSpecialTokens(t *testing.T) {
@@ -157,13 +170,105 @@ func TestExpandSpecialTokens(t *testing.T) {
 	}
 }
 
+func TestExpand_WithEnvAndWorkingDir(t *testing.T) {
+	portPicker, err := NewPortRangePicker([]*emulators.PortRange{&emulators.PortRange{Begin: 42, End: 44}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expander := newCommandExpander("brokerDir", portPicker)
+	command := &emulators.CommandLine{
+		Path:       "foo",
+		Args:       []string{"--port={port:bar}"},
+		Env:        map[string]string{"BAR_PORT": "{port:bar}", "DATA_DIR": "{dir:broker}/data"},
+		WorkingDir: "{dir:broker}/work",
+	}
+	err = expander.expand(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &emulators.CommandLine{
+		Path:       "foo",
+		Args:       []string{"--port=42"},
+		Env:        map[string]string{"BAR_PORT": "42", "DATA_DIR": "brokerDir/data"},
+		WorkingDir: "brokerDir/work",
+	}
+	if !proto.Equal(command, want) {
+		t.Errorf("Expected %v: %v", want, command)
+	}
+}
+
+func TestExpand_WithHostToken(t *testing.T) {
+	expander := newCommandExpander("brokerDir", &FreePortPicker{})
+	expander.hosts = func(emulatorId string) (string, error) {
+		if emulatorId != "datastore" {
+			return "", fmt.Errorf("emulator %q has no resolved host", emulatorId)
+		}
+		return "localhost:8081", nil
+	}
+	command := &emulators.CommandLine{
+		Path: "foo",
+		Args: []string{"--datastore={host:datastore}"},
+		Env:  map[string]string{"DATASTORE_EMULATOR_HOST": "{host:datastore}"},
+	}
+	err := expander.newScope("app").expand(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &emulators.CommandLine{
+		Path: "foo",
+		Args: []string{"--datastore=localhost:8081"},
+		Env:  map[string]string{"DATASTORE_EMULATOR_HOST": "localhost:8081"},
+	}
+	if !proto.Equal(command, want) {
+		t.Errorf("Expected %v: %v", want, command)
+	}
+
+	command = &emulators.CommandLine{Path: "foo", Args: []string{"--pubsub={host:pubsub}"}}
+	if err := expander.expand(command); err == nil {
+		t.Errorf("Expected an error for an emulator without a resolved host: %v", command)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	os.Setenv("TEST_ENV_QUX", "qux")
+	defer os.Unsetenv("TEST_ENV_QUX")
+	os.Setenv(BrokerAddressEnv, "localhost:1234")
+	defer os.Unsetenv(BrokerAddressEnv)
+
+	command := &emulators.CommandLine{Path: "foo"}
+	if env := commandEnv(command); env != nil {
+		t.Errorf("Expected the environment to be inherited: %v", env)
+	}
+
+	command.Env = map[string]string{"FOO": "bar", "TEST_ENV_QUX": "quux"}
+	env := commandEnv(command)
+	vars := make(map[string]bool)
+	for _, kv := range env {
+		vars[kv] = true
+	}
+	if !vars["FOO=bar"] || !vars["TEST_ENV_QUX=quux"] || vars["TEST_ENV_QUX=qux"] {
+		t.Errorf("Expected inherited variables to be overridden: %v", env)
+	}
+	if !vars["PATH="+os.Getenv("PATH")] {
+		t.Errorf("Expected PATH to be inherited: %v", env)
+	}
+
+	command.InheritEnv = &wrappers_pb.BoolValue{Value: false}
+	env = commandEnv(command)
+	want := []string{"FOO=bar", BrokerAddressEnv + "=localhost:1234", "TEST_ENV_QUX=quux"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Expected %v: %v", want, env)
+	}
+}
+
 func TestComputeResolveResponse(t *testing.T) {
 	// Host input, non-secure.
 	r, err := computeResolveResponse("foo", &emulators.ResolveRule{ResolvedHost: "bar", RequiresSecureConnection: false})
 	if err != nil {
 		t.Error(err)
 	}
-	want := &emulators.ResolveResponse{Target: "bar", RequiresSecureConnection: false}
+	want := &emulators.ResolveResponse{Target: "bar", RequiresSecureConnection: false, Host: "bar"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
@@ -173,7 +278,7 @@ func TestComputeResolveResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want = &emulators.ResolveResponse{Target: "bar", RequiresSecureConnection: true}
+	want = &emulators.ResolveResponse{Target: "bar", RequiresSecureConnection: true, Host: "bar"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
@@ -183,7 +288,7 @@ func TestComputeResolveResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want = &emulators.ResolveResponse{Target: "http://bar/baz", RequiresSecureConnection: false}
+	want = &emulators.ResolveResponse{Target: "http://bar/baz", RequiresSecureConnection: false, Host: "bar", Scheme: "http", Path: "/baz"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
@@ -191,7 +296,7 @@ func TestComputeResolveResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want = &emulators.ResolveResponse{Target: "http://bar/baz", RequiresSecureConnection: false}
+	want = &emulators.ResolveResponse{Target: "http://bar/baz", RequiresSecureConnection: false, Host: "bar", Scheme: "http", Path: "/baz"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
@@ -201,7 +306,7 @@ func TestComputeResolveResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want = &emulators.ResolveResponse{Target: "https://bar/baz", RequiresSecureConnection: true}
+	want = &emulators.ResolveResponse{Target: "https://bar/baz", RequiresSecureConnection: true, Host: "bar", Scheme: "https", Path: "/baz"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
@@ -209,12 +314,54 @@ func TestComputeResolveResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	want = &emulators.ResolveResponse{Target: "https://bar/baz", RequiresSecureConnection: true}
+	want = &emulators.ResolveResponse{Target: "https://bar/baz", RequiresSecureConnection: true, Host: "bar", Scheme: "https", Path: "/baz"}
 	if !proto.Equal(r, want) {
 		t.Errorf("want = %v, got %v", want, r)
 	}
 }
 
+func TestComputeResolveResponse_TargetForms(t *testing.T) {
+	rule := &emulators.ResolveRule{ResolvedHost: "localhost:8085"}
+	secureRule := &emulators.ResolveRule{ResolvedHost: "localhost:8085", RequiresSecureConnection: true}
+	grpcRule := &emulators.ResolveRule{ResolvedHost: "localhost:8085", ResolvedScheme: "grpc"}
+	tests := []struct {
+		target string
+		rule   *emulators.ResolveRule
+		want   *emulators.ResolveResponse
+	}{
+		{"pubsub.googleapis.com:443", rule,
+			&emulators.ResolveResponse{Target: "localhost:8085"}},
+		{"[::1]:443", rule,
+			&emulators.ResolveResponse{Target: "localhost:8085"}},
+		{"/google.pubsub.v1.Publisher/Publish", rule,
+			&emulators.ResolveResponse{Target: "localhost:8085", Path: "/google.pubsub.v1.Publisher/Publish"}},
+		{"grpc://pubsub.googleapis.com:443/foo", rule,
+			&emulators.ResolveResponse{Target: "grpc://localhost:8085/foo", Scheme: "grpc", Path: "/foo"}},
+		{"ws://example.com/chat?room=1", secureRule,
+			&emulators.ResolveResponse{Target: "wss://localhost:8085/chat?room=1", Scheme: "wss", Path: "/chat", RequiresSecureConnection: true}},
+		{"dns:///pubsub.googleapis.com:443", rule,
+			&emulators.ResolveResponse{Target: "dns:///localhost:8085", Scheme: "dns"}},
+		{"dns://8.8.8.8/pubsub.googleapis.com:443", rule,
+			&emulators.ResolveResponse{Target: "dns:///localhost:8085", Scheme: "dns"}},
+		{"dns:pubsub.googleapis.com:443", rule,
+			&emulators.ResolveResponse{Target: "dns:localhost:8085", Scheme: "dns"}},
+		{"https://pubsub.googleapis.com/v1/topics", grpcRule,
+			&emulators.ResolveResponse{Target: "grpc://localhost:8085/v1/topics", Scheme: "grpc", Path: "/v1/topics"}},
+	}
+	for _, test := range tests {
+		test.want.Host = "localhost"
+		test.want.Port = 8085
+		r, err := computeResolveResponse(test.target, test.rule)
+		if err != nil {
+			t.Errorf("%q: %v", test.target, err)
+			continue
+		}
+		if !proto.Equal(r, test.want) {
+			t.Errorf("%q: want = %v, got %v", test.target, test.want, r)
+		}
+	}
+}
+
 func TestCreateEmulator(t *testing.T) {
 	s := New()
 	_, err := s.CreateEmulator(nil, dummyEmulator)
@@ -279,6 +426,41 @@ func TestGetEmulator_WhenNotFound(t *testing.T) {
 	}
 }
 
+func TestGetEmulator_ReturnsCopy(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId}
+	emu, err := s.GetEmulator(nil, emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu.State = emulators.Emulator_ONLINE
+	emu.Rule.ResolvedHost = "somewhere:1234"
+	emu, err = s.GetEmulator(nil, emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_OFFLINE || emu.Rule.ResolvedHost != "" {
+		t.Errorf("Expected the emulator to be unchanged: %v", emu)
+	}
+	ruleId := &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId}
+	rule, err := s.GetResolveRule(nil, ruleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule.ResolvedHost = "somewhere:1234"
+	rule, err = s.GetResolveRule(nil, ruleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.ResolvedHost != "" {
+		t.Errorf("Expected the rule to be unchanged: %v", rule)
+	}
+}
+
 func TestListEmulators(t *testing.T) {
 	s := New()
 	want1 := &emulators.Emulator{EmulatorId: "foo",
@@ -457,468 +639,2874 @@ func TestStartEmulator_WhenContextDeadlineElapses(t *testing.T) {
 	}
 }
 
-func TestReportEmulatorOnline(t *testing.T) {
-	s := New()
-	_, err := s.CreateEmulator(nil, dummyEmulator)
+func TestStartEmulator_WhenProcessExits(t *testing.T) {
+	b, err := startNewBroker(brokerConfigWithDeadline(10 * time.Second))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer b.Shutdown()
 
-	s.emulators[dummyEmulator.EmulatorId].markStartingForTest()
-
-	req := emulators.ReportEmulatorOnlineRequest{
-		EmulatorId:     dummyEmulator.EmulatorId,
-		TargetPatterns: []string{"newPattern"},
-		ResolvedHost:   "t"}
-	_, err = s.ReportEmulatorOnline(nil, &req)
+	// Without --port, the sample emulator exits immediately.
+	realNoPort := proto.Clone(realEmulator).(*emulators.Emulator)
+	realNoPort.StartCommand.Args = []string{}
+	_, err = b.s.CreateEmulator(nil, realNoPort)
 	if err != nil {
-		t.Errorf("Reporting emulator online should not have failed. %v", err)
+		t.Fatal(err)
 	}
-
-	rule, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
+	emulatorId := emulators.EmulatorId{EmulatorId: realNoPort.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted: %v", err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	got := rule.ResolvedHost
-	want := req.ResolvedHost
-	if got != want {
-		t.Error("Want %q but got %q", want, got)
+	if emu.State != emulators.Emulator_CRASHED {
+		t.Errorf("Expected CRASHED: %s", emu.State)
 	}
-	if len(rule.TargetPatterns) != len(dummyEmulator.Rule.TargetPatterns)+len(req.TargetPatterns) {
-		t.Error("Target patterns were not merged correctly: %v", rule.TargetPatterns)
+	if emu.LastExit == nil || emu.LastExit.ExitCode == 0 {
+		t.Errorf("Expected a non-zero exit code: %v", emu.LastExit)
 	}
 }
 
-func TestReportEmulatorOnline_WhenNotFound(t *testing.T) {
-	s := New()
-	req := emulators.ReportEmulatorOnlineRequest{
-		EmulatorId:   dummyEmulator.EmulatorId,
-		ResolvedHost: "t"}
-	_, err := s.ReportEmulatorOnline(nil, &req)
-	if err == nil || grpc.Code(err) != codes.NotFound {
-		t.Errorf("Expected NotFound: %v", err)
+func TestEmulatorCrash(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	defer b.Shutdown()
 
-func TestReportEmulatorOnline_WhenOffline(t *testing.T) {
-	s := New()
-	_, err := s.CreateEmulator(nil, dummyEmulator)
+	_, err = b.s.CreateEmulator(nil, realEmulator)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-
-	req := emulators.ReportEmulatorOnlineRequest{
-		EmulatorId:   dummyEmulator.EmulatorId,
-		ResolvedHost: "t"}
-	_, err = s.ReportEmulatorOnline(nil, &req)
-	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
-		t.Errorf("Expected FailedPrecondition: %v", err)
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestReportEmulatorOnline_WhenStarted(t *testing.T) {
-	s := New()
-	_, err := s.CreateEmulator(nil, dummyEmulator)
+	// Kill the emulator process behind the broker's back.
+	b.s.mu.Lock()
+	process := b.s.emulators[realEmulator.EmulatorId].cmd.Process
+	b.s.mu.Unlock()
+	err = process.Kill()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var emu *emulators.Emulator
+	for time.Now().Before(deadline) {
+		b.s.mu.Lock()
+		emu = proto.Clone(b.s.emulators[realEmulator.EmulatorId].emulator).(*emulators.Emulator)
+		b.s.mu.Unlock()
+		if emu.State == emulators.Emulator_CRASHED {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if emu.State != emulators.Emulator_CRASHED {
+		t.Fatalf("Expected CRASHED: %s", emu.State)
+	}
+	if emu.Rule.ResolvedHost != "" {
+		t.Errorf("Expected empty resolved host: %s", emu.Rule.ResolvedHost)
+	}
+	if emu.LastExit == nil || emu.LastExit.Signal == "" {
+		t.Errorf("Expected the exit signal to be recorded: %v", emu.LastExit)
 	}
 
-	emu, _ := s.emulators[dummyEmulator.EmulatorId]
-	emu.markStartingForTest()
-	emu.markOnline()
-
-	req := emulators.ReportEmulatorOnlineRequest{
-		EmulatorId:   dummyEmulator.EmulatorId,
-		ResolvedHost: "t"}
-	_, err = s.ReportEmulatorOnline(nil, &req)
-	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
-		t.Errorf("Expected FailedPrecondition: %v", err)
+	// A crashed emulator can be started again.
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestStopEmulator(t *testing.T) {
-	b, err := startNewBroker(nil)
+func TestEmulatorRestart(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer b.Shutdown()
 
-	_, err = b.s.CreateEmulator(nil, realEmulator)
+	realWithRestart := proto.Clone(realEmulator).(*emulators.Emulator)
+	realWithRestart.RestartPolicy = &emulators.RestartPolicy{
+		Mode:           emulators.RestartPolicy_ALWAYS,
+		InitialBackoff: &duration_pb.Duration{Nanos: int32(10 * time.Millisecond)}}
+	_, err = b.s.CreateEmulator(nil, realWithRestart)
 	if err != nil {
 		t.Fatal(err)
 	}
-	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	emulatorId := emulators.EmulatorId{EmulatorId: realWithRestart.EmulatorId}
 	_, err = b.s.StartEmulator(nil, &emulatorId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	port, err := realEmulatorPort(b)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if emu.Rule.ResolvedHost == "" {
-		t.Fatal("Expected non-empty resolved host")
+
+	b.s.mu.Lock()
+	process := b.s.emulators[realWithRestart.EmulatorId].cmd.Process
+	b.s.mu.Unlock()
+	err = process.Kill()
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, err = b.s.StopEmulator(nil, &emulatorId)
+	deadline := time.Now().Add(10 * time.Second)
+	var emu *emulators.Emulator
+	for time.Now().Before(deadline) {
+		b.s.mu.Lock()
+		emu = proto.Clone(b.s.emulators[realWithRestart.EmulatorId].emulator).(*emulators.Emulator)
+		b.s.mu.Unlock()
+		if emu.RestartCount == 1 && emu.State == emulators.Emulator_ONLINE {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if emu.State != emulators.Emulator_ONLINE || emu.RestartCount != 1 {
+		t.Fatalf("Expected ONLINE after 1 restart: %s, %d", emu.State, emu.RestartCount)
+	}
+	want := fmt.Sprintf("localhost:%d", port)
+	if emu.Rule.ResolvedHost != want {
+		t.Errorf("Expected the restarted emulator to reuse its port: %s (want: %s)", emu.Rule.ResolvedHost, want)
+	}
+}
+
+func TestEmulatorRestart_WhenMaxRetriesReached(t *testing.T) {
+	b, err := startNewBroker(brokerConfigWithDeadline(10 * time.Second))
 	if err != nil {
 		t.Fatal(err)
 	}
-	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	defer b.Shutdown()
+
+	// Without --port, the sample emulator exits immediately.
+	realNoPort := proto.Clone(realEmulator).(*emulators.Emulator)
+	realNoPort.StartCommand.Args = []string{}
+	realNoPort.RestartPolicy = &emulators.RestartPolicy{
+		Mode:           emulators.RestartPolicy_ON_FAILURE,
+		MaxRetries:     2,
+		InitialBackoff: &duration_pb.Duration{Nanos: int32(10 * time.Millisecond)}}
+	_, err = b.s.CreateEmulator(nil, realNoPort)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if emu.State != emulators.Emulator_OFFLINE {
-		t.Errorf("Expected OFFLINE: %s", emu.State)
+	emulatorId := emulators.EmulatorId{EmulatorId: realNoPort.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted: %v", err)
 	}
-	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if emu.Rule.ResolvedHost != "" {
-		t.Fatal("Expected empty resolved host")
+	if emu.State != emulators.Emulator_CRASHED {
+		t.Errorf("Expected CRASHED: %s", emu.State)
 	}
-	// Restart the emulator.
-	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if emu.RestartCount != 2 {
+		t.Errorf("Expected 2 restarts: %d", emu.RestartCount)
+	}
+}
+
+func TestStartEmulator_WhenLaunchFails(t *testing.T) {
+	s := New()
+	defer s.Clear()
+
+	missing := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	missing.StartCommand.Path = filepath.Join(tmpDir, "missing")
+	_, err := s.CreateEmulator(nil, missing)
 	if err != nil {
 		t.Fatal(err)
 	}
-	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	emulatorId := emulators.EmulatorId{EmulatorId: missing.EmulatorId}
+	_, err = s.StartEmulator(nil, &emulatorId)
+	if err == nil {
+		t.Fatal("Expected the start to fail")
+	}
+	emu, err := s.GetEmulator(nil, &emulatorId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if emu.Rule.ResolvedHost == "" {
-		t.Fatal("Expected non-empty resolved host")
+	if emu.State != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected OFFLINE: %s", emu.State)
 	}
 }
 
-func TestStopEmulator_WhenNotFound(t *testing.T) {
-	s := New()
-	_, err := s.StopEmulator(nil, &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId})
-	if err == nil || grpc.Code(err) != codes.NotFound {
-		t.Errorf("Expected NotFound: %v", err)
+func TestEmulatorRestart_WhenLaunchFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Shell scripts are not supported on Windows")
 	}
-}
-
-func TestStopEmulator_WhenOffline(t *testing.T) {
-	s := New()
-	_, err := s.CreateEmulator(nil, dummyEmulator)
+	b, err := startNewBroker(nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	_, err = s.StopEmulator(nil, &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId})
+	defer b.Shutdown()
+
+	dir, err := ioutil.TempDir(tmpDir, "restart")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-}
-
-func TestCreateResolveRule(t *testing.T) {
-	s := New()
-	rule := dummyEmulator.Rule
-	_, err := s.CreateResolveRule(nil, rule)
+	script := writeFile(t, dir, "exit.sh", "#!/bin/sh\nexit 1\n")
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	vanishing := &emulators.Emulator{
+		EmulatorId:   "vanishing",
+		Rule:         &emulators.ResolveRule{RuleId: "vanishing_rule"},
+		StartCommand: &emulators.CommandLine{Path: script},
+		RestartPolicy: &emulators.RestartPolicy{
+			Mode:           emulators.RestartPolicy_ALWAYS,
+			MaxRetries:     2,
+			InitialBackoff: &duration_pb.Duration{Nanos: int32(10 * time.Millisecond)}},
+	}
+	_, err = b.s.CreateEmulator(nil, vanishing)
 	if err != nil {
 		t.Fatal(err)
 	}
-	got, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: rule.RuleId})
+	// Every restart fails to launch the removed script.
+	b.s.mu.Lock()
+	err = b.s.emulators[vanishing.EmulatorId].start()
+	if err == nil {
+		err = os.Remove(script)
+	}
+	b.s.mu.Unlock()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !proto.Equal(got, rule) {
-		t.Errorf("Failed to find the same rule; want = %v, got %v", rule, got)
+	emu := waitForEmulator(b, vanishing.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.State == emulators.Emulator_CRASHED
+	})
+	if emu.State != emulators.Emulator_CRASHED {
+		t.Errorf("Expected CRASHED: %s", emu.State)
+	}
+	if emu.RestartCount != 2 {
+		t.Errorf("Expected 2 restarts: %d", emu.RestartCount)
 	}
 }
 
-func TestCreateResolveRule_WithInvalidRuleId(t *testing.T) {
+func TestCreateEmulator_WithInvalidRestartPolicy(t *testing.T) {
 	s := New()
-	badRule := emulators.ResolveRule{RuleId: "my/mistake", TargetPatterns: []string{"pattern1"}}
-	_, err := s.CreateResolveRule(nil, &badRule)
+	dummy := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	dummy.RestartPolicy = &emulators.RestartPolicy{Mode: emulators.RestartPolicy_ALWAYS, MaxRetries: -1}
+	_, err := s.CreateEmulator(nil, dummy)
 	if err == nil || grpc.Code(err) != codes.InvalidArgument {
-		t.Fatalf("Expected InvalidArgument: %v", err)
+		t.Errorf("Expected InvalidArgument: %v", err)
 	}
 }
 
-func TestCreateResolveRule_WithInvalidTargetPattern(t *testing.T) {
-	s := New()
-	badRule := emulators.ResolveRule{RuleId: "bad", TargetPatterns: []string{"["}}
-	_, err := s.CreateResolveRule(nil, &badRule)
-	if err == nil || grpc.Code(err) != codes.InvalidArgument {
-		t.Fatalf("Expected InvalidArgument: %v", err)
+// Returns realEmulator configured to not register itself, but to be reported
+// online by a readiness check using the given probe.
+func realEmulatorWithReadinessCheck(probe *emulators.Probe) *emulators.Emulator {
+	realNoReg := proto.Clone(realEmulator).(*emulators.Emulator)
+	realNoReg.StartCommand.Args = []string{"--port={port:real}"}
+	realNoReg.ReadinessCheck = &emulators.ReadinessCheck{
+		Probe:        probe,
+		ResolvedHost: "localhost:{port:real}",
 	}
+	return realNoReg
 }
 
-func TestCreateResolveRule_WhenIdenticalRuleAlreadyExists(t *testing.T) {
-	s := New()
-	rule := dummyEmulator.Rule
-	_, err := s.CreateResolveRule(nil, rule)
-	if err != nil {
-		t.Fatal(err)
+func TestStartEmulator_WithReadinessCheck(t *testing.T) {
+	probes := []*emulators.Probe{
+		&emulators.Probe{Check: &emulators.Probe_HttpGet{&emulators.HttpGetProbe{
+			Url:        "http://localhost:{port:real}/status",
+			BodyRegexp: "ok"}}},
+		&emulators.Probe{Check: &emulators.Probe_TcpConnect{&emulators.TcpConnectProbe{}}},
 	}
-	_, err = s.CreateResolveRule(nil, rule)
-	if err != nil {
-		t.Errorf("Expected OK: %v", err)
+	for _, probe := range probes {
+		testStartEmulatorWithReadinessCheck(t, probe)
 	}
 }
 
-func TestCreateResolveRule_WhenDifferentRuleAlreadyExists(t *testing.T) {
-	s := New()
-	rule := *dummyEmulator.Rule
-	_, err := s.CreateResolveRule(nil, &rule)
+func testStartEmulatorWithReadinessCheck(t *testing.T, probe *emulators.Probe) {
+	b, err := startNewBroker(brokerConfigWithDeadline(10 * time.Second))
 	if err != nil {
 		t.Fatal(err)
 	}
-	rule.ResolvedHost = rule.ResolvedHost + "-2"
-	_, err = s.CreateResolveRule(nil, &rule)
+	defer b.Shutdown()
+
+	emulator := realEmulatorWithReadinessCheck(probe)
+	_, err = b.s.CreateEmulator(nil, emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: emulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatalf("Start failed for probe %v: %v", probe, err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_ONLINE {
+		t.Errorf("Expected ONLINE: %s", emu.State)
+	}
+	want := fmt.Sprintf("localhost:%d", emu.Ports["real"])
+	if emu.Rule.ResolvedHost != want {
+		t.Errorf("Expected resolved host %q: %q", want, emu.Rule.ResolvedHost)
+	}
+}
+
+func TestStartEmulator_WhenReadinessCheckFails(t *testing.T) {
+	b, err := startNewBroker(brokerConfigWithDeadline(1 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	emulator := realEmulatorWithReadinessCheck(&emulators.Probe{
+		Check: &emulators.Probe_HttpGet{&emulators.HttpGetProbe{
+			Url:        "http://localhost:{port:real}/status",
+			BodyRegexp: "never"}}})
+	_, err = b.s.CreateEmulator(nil, emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emulator.EmulatorId})
+	if err == nil || grpc.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded: %v", err)
+	}
+}
+
+func TestCreateEmulator_WithInvalidReadinessCheck(t *testing.T) {
+	cases := []*emulators.ReadinessCheck{
+		&emulators.ReadinessCheck{ResolvedHost: "foo"},
+		&emulators.ReadinessCheck{Probe: &emulators.Probe{}, ResolvedHost: "foo"},
+		&emulators.ReadinessCheck{Probe: &emulators.Probe{
+			Check: &emulators.Probe_TcpConnect{&emulators.TcpConnectProbe{}}}},
+		&emulators.ReadinessCheck{Probe: &emulators.Probe{
+			Check: &emulators.Probe_HttpGet{&emulators.HttpGetProbe{BodyRegexp: "["}}}, ResolvedHost: "foo"},
+	}
+	for _, c := range cases {
+		s := New()
+		dummy := proto.Clone(dummyEmulator).(*emulators.Emulator)
+		dummy.ReadinessCheck = c
+		_, err := s.CreateEmulator(nil, dummy)
+		if err == nil || grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %v: %v", c, err)
+		}
+	}
+}
+
+// Returns realEmulator with a liveness check of the sample emulator's status,
+// which fails if the status does not match statusRegexp.
+func realEmulatorWithLivenessCheck(statusRegexp string) *emulators.Emulator {
+	emulator := proto.Clone(realEmulator).(*emulators.Emulator)
+	emulator.LivenessCheck = &emulators.LivenessCheck{
+		Probe: &emulators.Probe{Check: &emulators.Probe_HttpGet{&emulators.HttpGetProbe{
+			Url:        "http://localhost:{port:real}/status",
+			BodyRegexp: statusRegexp}}},
+		Period:           &duration_pb.Duration{Nanos: int32(50 * time.Millisecond)},
+		FailureThreshold: 2,
+	}
+	return emulator
+}
+
+// Waits for the emulator to satisfy cond, and returns a copy of it.
+func waitForEmulator(b *grpcServer, id string, cond func(*emulators.Emulator) bool) *emulators.Emulator {
+	deadline := time.Now().Add(5 * time.Second)
+	var emu *emulators.Emulator
+	for time.Now().Before(deadline) {
+		b.s.mu.Lock()
+		emu = proto.Clone(b.s.emulators[id].emulator).(*emulators.Emulator)
+		b.s.mu.Unlock()
+		if cond(emu) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return emu
+}
+
+func TestLivenessCheck_WhenHealthy(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	emulator := realEmulatorWithLivenessCheck("ok")
+	_, err = b.s.CreateEmulator(nil, emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := waitForEmulator(b, emulator.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.Health != nil && e.Health.Status != emulators.HealthStatus_UNKNOWN
+	})
+	if emu.Health == nil || emu.Health.Status != emulators.HealthStatus_HEALTHY {
+		t.Errorf("Expected HEALTHY: %v", emu.Health)
+	}
+}
+
+func TestLivenessCheck_WhenUnhealthy(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	emulator := realEmulatorWithLivenessCheck("never")
+	_, err = b.s.CreateEmulator(nil, emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := waitForEmulator(b, emulator.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.Health != nil && e.Health.Status == emulators.HealthStatus_UNHEALTHY
+	})
+	if emu.Health == nil || emu.Health.Status != emulators.HealthStatus_UNHEALTHY {
+		t.Fatalf("Expected UNHEALTHY: %v", emu.Health)
+	}
+	if emu.Rule.ResolvedHost != "" {
+		t.Errorf("Expected empty resolved host: %s", emu.Rule.ResolvedHost)
+	}
+	if emu.State != emulators.Emulator_ONLINE {
+		t.Errorf("Expected ONLINE: %s", emu.State)
+	}
+}
+
+func TestLivenessCheck_WhenUnhealthyWithRestart(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	emulator := realEmulatorWithLivenessCheck("never")
+	emulator.LivenessCheck.RestartWhenUnhealthy = true
+	emulator.RestartPolicy = &emulators.RestartPolicy{
+		InitialBackoff: &duration_pb.Duration{Nanos: int32(10 * time.Millisecond)}}
+	_, err = b.s.CreateEmulator(nil, emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := waitForEmulator(b, emulator.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.RestartCount > 0
+	})
+	if emu.RestartCount == 0 {
+		t.Errorf("Expected the unhealthy emulator to be restarted")
+	}
+}
+
+func TestLivenessCheck_WhenUnhealthyWithRestartIgnoringStopSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Stop signals are not supported on Windows")
+	}
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// Nothing listens on the probed port, and the stop signal is ignored.
+	stubborn := &emulators.Emulator{
+		EmulatorId: "stubborn",
+		Rule:       &emulators.ResolveRule{RuleId: "stubborn_rule"},
+		StartCommand: &emulators.CommandLine{
+			Path: "/bin/sh",
+			Args: []string{"-c", "trap '' INT TERM; sleep 60"},
+		},
+		LivenessCheck: &emulators.LivenessCheck{
+			Probe: &emulators.Probe{Check: &emulators.Probe_TcpConnect{&emulators.TcpConnectProbe{
+				Address: "localhost:{port:unused}"}}},
+			Period:               &duration_pb.Duration{Nanos: int32(50 * time.Millisecond)},
+			FailureThreshold:     2,
+			RestartWhenUnhealthy: true,
+		},
+		RestartPolicy: &emulators.RestartPolicy{
+			InitialBackoff: &duration_pb.Duration{Nanos: int32(10 * time.Millisecond)}},
+		StopGracePeriod: &duration_pb.Duration{Nanos: int32(200 * time.Millisecond)},
+	}
+	_, err = b.s.CreateEmulator(nil, stubborn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.s.mu.Lock()
+	emu := b.s.emulators[stubborn.EmulatorId]
+	err = emu.start()
+	if err == nil {
+		emu.markOnline()
+		b.s.startLivenessCheck(emu)
+	}
+	b.s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := waitForEmulator(b, stubborn.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.RestartCount > 0
+	})
+	if e.RestartCount == 0 {
+		t.Fatalf("Expected the unhealthy emulator to be restarted: %v", e)
+	}
+	if e.LastExit == nil || e.LastExit.Signal != syscall.SIGKILL.String() {
+		t.Errorf("Expected the unhealthy emulator to be killed: %v", e.LastExit)
+	}
+}
+
+func TestStartEmulator_RecordsPorts(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The emulator registers itself using the port it was started with.
+	want := fmt.Sprintf("localhost:%d", emu.Ports["real"])
+	if len(emu.Ports) != 1 || emu.Rule.ResolvedHost != want {
+		t.Errorf("Expected ports matching resolved host %q: %v", emu.Rule.ResolvedHost, emu.Ports)
+	}
+	if emu.StartCommand.Args[1] != "--port={port:real}" {
+		t.Errorf("Expected the start command to remain a template: %v", emu.StartCommand.Args)
+	}
+}
+
+// Returns a copy of realEmulator with a different id and rule.
+func anotherRealEmulator(id string) *emulators.Emulator {
+	emu := proto.Clone(realEmulator).(*emulators.Emulator)
+	emu.EmulatorId = id
+	emu.Rule.RuleId = id + "_rule"
+	emu.Rule.TargetPatterns = []string{id + "_service"}
+	emu.StartCommand.Args = []string{"--register", "--port={port:real}", "--rule_id=" + emu.Rule.RuleId}
+	return emu
+}
+
+func TestStartEmulator_WithPortScopes(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	ports := make(map[int32]bool)
+	for _, emu := range []*emulators.Emulator{realEmulator, anotherRealEmulator("real2")} {
+		_, err = b.s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emulatorId := emulators.EmulatorId{EmulatorId: emu.EmulatorId}
+		_, err = b.s.StartEmulator(nil, &emulatorId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := b.s.GetEmulator(nil, &emulatorId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[got.Ports["real"]] = true
+	}
+	if len(ports) != 2 {
+		t.Errorf("Expected each emulator to have its own port: %v", ports)
+	}
+}
+
+func TestStartEmulator_WithDependencies(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// The dependency doesn't need to exist when the dependent is created.
+	app := anotherRealEmulator("app")
+	app.DependsOn = []string{realEmulator.EmulatorId}
+	app.StartCommand.Env = map[string]string{"REAL_HOST": "{host:real}"}
+	for _, emu := range []*emulators.Emulator{app, realEmulator} {
+		_, err = b.s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: app.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{realEmulator.EmulatorId, app.EmulatorId} {
+		emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if emu.State != emulators.Emulator_ONLINE {
+			t.Errorf("Expected %q to be ONLINE: %s", id, emu.State)
+		}
+	}
+
+	// The dependency is not stopped while the dependent is running, unless
+	// the stop cascades.
+	req := &emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StopEmulator(nil, req)
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition: %v", err)
+	}
+	_, err = b.s.StopEmulatorCascade(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{realEmulator.EmulatorId, app.EmulatorId} {
+		emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if emu.State != emulators.Emulator_OFFLINE {
+			t.Errorf("Expected %q to be OFFLINE: %s", id, emu.State)
+		}
+	}
+}
+
+func TestDeleteEmulator_WhenDependedOn(t *testing.T) {
+	s := New()
+	app := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	app.EmulatorId = "app"
+	app.Rule = &emulators.ResolveRule{RuleId: "app_rule"}
+	app.DependsOn = []string{dummyEmulator.EmulatorId}
+	for _, emu := range []*emulators.Emulator{dummyEmulator, app} {
+		_, err := s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dummyId := &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId}
+	_, err := s.DeleteEmulator(nil, dummyId)
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition: %v", err)
+	}
+	// Once the dependent is deleted, so can the dependency.
+	_, err = s.DeleteEmulator(nil, &emulators.EmulatorId{EmulatorId: app.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DeleteEmulator(nil, dummyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartEmulator_WhenDependencyDoesNotExist(t *testing.T) {
+	s := New()
+	emu := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	emu.DependsOn = []string{"missing"}
+	_, err := s.CreateEmulator(nil, emu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: emu.EmulatorId})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
+	}
+}
+
+func TestCreateEmulator_WithInvalidDependencies(t *testing.T) {
+	s := New()
+	a := anotherRealEmulator("a")
+	a.DependsOn = []string{"b"}
+	_, err := s.CreateEmulator(nil, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := anotherRealEmulator("b")
+	b.DependsOn = []string{"c"}
+	c := anotherRealEmulator("c")
+	c.DependsOn = []string{"a"}
+	_, err = s.CreateEmulator(nil, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateEmulator(nil, c)
+	if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "c -> a -> b -> c") {
+		t.Errorf("Expected InvalidArgument for a cycle: %v", err)
+	}
+
+	self := anotherRealEmulator("self")
+	self.DependsOn = []string{"self"}
+	hostOfOther := anotherRealEmulator("host_of_other")
+	hostOfOther.StartCommand.Env = map[string]string{"A_HOST": "{host:a}"}
+	for _, emu := range []*emulators.Emulator{self, hostOfOther} {
+		_, err = s.CreateEmulator(nil, emu)
+		if grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %q: %v", emu.EmulatorId, err)
+		}
+	}
+}
+
+func TestStopEmulator_ReleasesPorts(t *testing.T) {
+	port, err := (&FreePortPicker{}).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &emulators.BrokerConfig{
+		PortRanges: []*emulators.PortRange{&emulators.PortRange{Begin: int32(port), End: int32(port + 1)}}}
+	b, err := startNewBroker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	real2 := anotherRealEmulator("real2")
+	for _, emu := range []*emulators.Emulator{realEmulator, real2} {
+		_, err = b.s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emu.Ports) != 0 {
+		t.Errorf("Expected no ports once stopped: %v", emu.Ports)
+	}
+
+	// The only port is available to the other emulator.
+	emulatorId = emulators.EmulatorId{EmulatorId: real2.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.Ports["real"] != int32(port) {
+		t.Errorf("Expected port %d: %v", port, emu.Ports)
+	}
+}
+
+func TestCreateEmulator_WithResolvedHostTemplateWithoutReadinessCheck(t *testing.T) {
+	s := New()
+	// Nothing would tell when the emulator is serving on the port.
+	realWithTemplate := proto.Clone(realEmulator).(*emulators.Emulator)
+	realWithTemplate.StartCommand.Args = []string{"--port={port:real}"}
+	realWithTemplate.Rule.ResolvedHost = "localhost:{port:real}"
+	_, err := s.CreateEmulator(nil, realWithTemplate)
+	if err == nil || grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestStartEmulator_WithReadinessCheckAndResolvedHostTemplate(t *testing.T) {
+	emu := realEmulatorWithReadinessCheck(&emulators.Probe{
+		Check: &emulators.Probe_TcpConnect{&emulators.TcpConnectProbe{}}})
+	emu.Rule.ResolvedHost = emu.ReadinessCheck.ResolvedHost
+	emu.ReadinessCheck.ResolvedHost = ""
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, emu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: emu.EmulatorId}
+	got, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Rule.ResolvedHost != "" {
+		t.Errorf("Expected empty resolved host before starting: %s", got.Rule.ResolvedHost)
+	}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("localhost:%d", got.Ports["real"])
+	if got.Rule.ResolvedHost != want {
+		t.Errorf("Expected resolved host %q: %q", want, got.Rule.ResolvedHost)
+	}
+}
+
+func TestReportEmulatorOnline(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Error(err)
+	}
+
+	s.emulators[dummyEmulator.EmulatorId].markStartingForTest()
+
+	req := emulators.ReportEmulatorOnlineRequest{
+		EmulatorId:     dummyEmulator.EmulatorId,
+		TargetPatterns: []string{"newPattern"},
+		ResolvedHost:   "t"}
+	_, err = s.ReportEmulatorOnline(nil, &req)
+	if err != nil {
+		t.Errorf("Reporting emulator online should not have failed. %v", err)
+	}
+
+	rule, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
+	if err != nil {
+		t.Error(err)
+	}
+	got := rule.ResolvedHost
+	want := req.ResolvedHost
+	if got != want {
+		t.Error("Want %q but got %q", want, got)
+	}
+	if len(rule.TargetPatterns) != len(dummyEmulator.Rule.TargetPatterns)+len(req.TargetPatterns) {
+		t.Error("Target patterns were not merged correctly: %v", rule.TargetPatterns)
+	}
+}
+
+func TestReportEmulatorOnline_WhenNotFound(t *testing.T) {
+	s := New()
+	req := emulators.ReportEmulatorOnlineRequest{
+		EmulatorId:   dummyEmulator.EmulatorId,
+		ResolvedHost: "t"}
+	_, err := s.ReportEmulatorOnline(nil, &req)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestReportEmulatorOnline_WhenOffline(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Error(err)
+	}
+
+	req := emulators.ReportEmulatorOnlineRequest{
+		EmulatorId:   dummyEmulator.EmulatorId,
+		ResolvedHost: "t"}
+	_, err = s.ReportEmulatorOnline(nil, &req)
+	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
+	}
+}
+
+func TestReportEmulatorOnline_WhenStarted(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Error(err)
+	}
+
+	emu, _ := s.emulators[dummyEmulator.EmulatorId]
+	emu.markStartingForTest()
+	emu.markOnline()
+
+	req := emulators.ReportEmulatorOnlineRequest{
+		EmulatorId:   dummyEmulator.EmulatorId,
+		ResolvedHost: "t"}
+	_, err = s.ReportEmulatorOnline(nil, &req)
+	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
+	}
+}
+
+func TestStopEmulator(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.Rule.ResolvedHost == "" {
+		t.Fatal("Expected non-empty resolved host")
+	}
+	_, err = b.s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected OFFLINE: %s", emu.State)
+	}
+	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.Rule.ResolvedHost != "" {
+		t.Fatal("Expected empty resolved host")
+	}
+	// Restart the emulator.
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err = b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.Rule.ResolvedHost == "" {
+		t.Fatal("Expected non-empty resolved host")
+	}
+}
+
+func TestStopEmulator_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.StopEmulator(nil, &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestStopEmulator_WhenOffline(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = s.StopEmulator(nil, &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStopEmulator_WithStopSignal(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	realWithSignal := proto.Clone(realEmulator).(*emulators.Emulator)
+	realWithSignal.StopSignal = "SIGINT"
+	_, err = b.s.CreateEmulator(nil, realWithSignal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realWithSignal.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected OFFLINE: %s", emu.State)
+	}
+	if emu.LastExit == nil || emu.LastExit.Signal != syscall.SIGINT.String() {
+		t.Errorf("Expected the emulator to exit with SIGINT: %v", emu.LastExit)
+	}
+}
+
+func TestStopEmulator_WhenGracePeriodElapses(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Stop signals are not supported on Windows")
+	}
+	s := New()
+	defer s.Clear()
+
+	// The ignored signal is inherited by sleep.
+	stubborn := &emulators.Emulator{
+		EmulatorId: "stubborn",
+		Rule:       &emulators.ResolveRule{RuleId: "stubborn_rule"},
+		StartCommand: &emulators.CommandLine{
+			Path: "/bin/sh",
+			Args: []string{"-c", "trap '' TERM; sleep 60"},
+		},
+		StopGracePeriod: &duration_pb.Duration{Nanos: int32(200 * time.Millisecond)},
+	}
+	_, err := s.CreateEmulator(nil, stubborn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	err = s.emulators[stubborn.EmulatorId].start()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give the shell time to install the trap.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	emulatorId := emulators.EmulatorId{EmulatorId: stubborn.EmulatorId}
+	_, err = s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the emulator to be killed after the grace period: %v", elapsed)
+	}
+	emu, err := s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected OFFLINE: %s", emu.State)
+	}
+	if emu.LastExit == nil || emu.LastExit.Signal != syscall.SIGKILL.String() {
+		t.Errorf("Expected the emulator to be killed: %v", emu.LastExit)
+	}
+}
+
+func TestCreateEmulator_WithInvalidStopSignal(t *testing.T) {
+	s := New()
+	emu := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	emu.StopSignal = "SIGWHATEVER"
+	_, err := s.CreateEmulator(nil, emu)
+	if err == nil || grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestStartEmulator_WithEnvAndWorkingDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Requires a POSIX shell")
+	}
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	printer := &emulators.Emulator{
+		EmulatorId: "printer",
+		Rule:       &emulators.ResolveRule{RuleId: "printer_rule"},
+		StartCommand: &emulators.CommandLine{
+			Path:       "/bin/sh",
+			Args:       []string{"-c", "echo \"$FOO $(pwd)\""},
+			Env:        map[string]string{"FOO": "{port:foo}"},
+			InheritEnv: &wrappers_pb.BoolValue{Value: false},
+			WorkingDir: tmpDir,
+		},
+	}
+	_, err = b.s.CreateEmulator(nil, printer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.s.mu.Lock()
+	emu := b.s.emulators[printer.EmulatorId]
+	err = emu.start()
+	b.s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEmulator(b, printer.EmulatorId, func(e *emulators.Emulator) bool {
+		return e.State == emulators.Emulator_CRASHED
+	})
+	lines, _, _ := emu.log.read(0)
+	// The working directory may be a symlink, so only its name is compared.
+	want := re.MustCompile("^[0-9]+ .*" + re.QuoteMeta(filepath.Base(tmpDir)) + "$")
+	if len(lines) != 1 || !want.MatchString(lines[0].Text) {
+		t.Errorf("Expected a port followed by the working directory: %v", lines)
+	}
+}
+
+func TestCreateEmulator_WithInvalidEnv(t *testing.T) {
+	s := New()
+	emu := proto.Clone(dummyEmulator).(*emulators.Emulator)
+	emu.StartCommand.Env = map[string]string{"FOO=BAR": "baz"}
+	_, err := s.CreateEmulator(nil, emu)
+	if err == nil || grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestEmulatorLog(t *testing.T) {
+	emuLog, err := newEmulatorLog(3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		emuLog.write(emulators.LogLine_STDOUT, strconv.Itoa(i))
+	}
+	lines, next, updated := emuLog.read(0)
+	texts := []string{}
+	for _, line := range lines {
+		texts = append(texts, line.Text)
+	}
+	if !reflect.DeepEqual(texts, []string{"2", "3", "4"}) {
+		t.Errorf("Expected the last 3 lines: %v", texts)
+	}
+	if next != 5 {
+		t.Errorf("Expected next line 5: %d", next)
+	}
+	tail := filterLogLines(lines, 1, time.Time{})
+	if len(tail) != 1 || tail[0].Text != "4" {
+		t.Errorf("Expected the last line: %v", tail)
+	}
+
+	emuLog.write(emulators.LogLine_STDERR, "5")
+	select {
+	case <-updated:
+	default:
+		t.Error("Expected readers to be notified of the new line")
+	}
+	lines, next, updated = emuLog.read(next)
+	if len(lines) != 1 || lines[0].Text != "5" || lines[0].Stream != emulators.LogLine_STDERR {
+		t.Errorf("Expected only the new line: %v", lines)
+	}
+	emuLog.close()
+	_, _, updated = emuLog.read(next)
+	if updated != nil {
+		t.Error("Expected no updates after close")
+	}
+}
+
+// Returns all lines received from the stream until it ends.
+func receiveLogLines(stream emulators.Broker_GetEmulatorLogsClient) ([]*emulators.LogLine, error) {
+	var lines []*emulators.LogLine
+	for {
+		line, err := stream.Recv()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestGetEmulatorLogs(t *testing.T) {
+	logDir := filepath.Join(tmpDir, "logs")
+	b, err := startNewBroker(&emulators.BrokerConfig{EmulatorLogDir: logDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := NewClientConnection(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.BrokerClient.GetEmulatorLogs(ctx,
+		&emulators.GetEmulatorLogsRequest{EmulatorId: realEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := receiveLogLines(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range lines {
+		if line.Stream == emulators.LogLine_STDERR && strings.Contains(line.Text, "serving on port") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the emulator output: %v", lines)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(logDir, realEmulator.EmulatorId+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "serving on port") {
+		t.Errorf("Expected the emulator output in the log file: %s", content)
+	}
+}
+
+func TestGetEmulatorLogs_WithFollow(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := NewClientConnection(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := conn.BrokerClient.GetEmulatorLogs(ctx,
+		&emulators.GetEmulatorLogsRequest{EmulatorId: realEmulator.EmulatorId, Tail: 1, Follow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream ends once the emulator is deleted.
+	_, err = b.s.DeleteEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiveLogLines(stream)
+	if err != nil {
+		t.Errorf("Expected the stream to end: %v", err)
+	}
+}
+
+func TestGetEmulatorLogs_WhenNotFound(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	conn, err := NewClientConnection(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.BrokerClient.GetEmulatorLogs(ctx,
+		&emulators.GetEmulatorLogsRequest{EmulatorId: dummyEmulator.EmulatorId})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestCreateResolveRule(t *testing.T) {
+	s := New()
+	rule := dummyEmulator.Rule
+	_, err := s.CreateResolveRule(nil, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: rule.RuleId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, rule) {
+		t.Errorf("Failed to find the same rule; want = %v, got %v", rule, got)
+	}
+}
+
+func TestCreateResolveRule_WithInvalidRuleId(t *testing.T) {
+	s := New()
+	badRule := emulators.ResolveRule{RuleId: "my/mistake", TargetPatterns: []string{"pattern1"}}
+	_, err := s.CreateResolveRule(nil, &badRule)
+	if err == nil || grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestCreateResolveRule_WithInvalidTargetPattern(t *testing.T) {
+	s := New()
+	badRule := emulators.ResolveRule{RuleId: "bad", TargetPatterns: []string{"["}}
+	_, err := s.CreateResolveRule(nil, &badRule)
+	if err == nil || grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestCreateResolveRule_WhenIdenticalRuleAlreadyExists(t *testing.T) {
+	s := New()
+	rule := dummyEmulator.Rule
+	_, err := s.CreateResolveRule(nil, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateResolveRule(nil, rule)
+	if err != nil {
+		t.Errorf("Expected OK: %v", err)
+	}
+}
+
+func TestCreateResolveRule_WhenDifferentRuleAlreadyExists(t *testing.T) {
+	s := New()
+	rule := *dummyEmulator.Rule
+	_, err := s.CreateResolveRule(nil, &rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule.ResolvedHost = rule.ResolvedHost + "-2"
+	_, err = s.CreateResolveRule(nil, &rule)
+	if err == nil || grpc.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists: %v", err)
+	}
+}
+
+func TestGetResolveRule_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestUpdateResolveRule(t *testing.T) {
+	s := New()
+	rule := *dummyEmulator.Rule
+	_, err := s.CreateResolveRule(nil, &rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Specify just a single pattern. This should get merged with the existing
+	// ones.
+	rule.TargetPatterns = []string{"newPattern"}
+	updateResp, err := s.UpdateResolveRule(nil, &rule)
+	if err != nil {
+		t.Fatalf("Failed to update rule: %v", err)
+	}
+	getResp, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: rule.RuleId})
+	if err != nil {
+		t.Fatalf("Failed to get rule: %v", err)
+	}
+	if !proto.Equal(updateResp, getResp) {
+		t.Fatalf("Expected %v: %v", getResp, updateResp)
+	}
+	patterns := merge(dummyEmulator.Rule.TargetPatterns, rule.TargetPatterns)
+	if !unorderedEqual(getResp.TargetPatterns, patterns) {
+		t.Fatalf("Expected %v: %v", patterns, getResp.TargetPatterns)
+	}
+}
+
+func TestUpdateResolveRule_WithOtherFields(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &emulators.ResolveRule{
+		RuleId:         dummyEmulator.Rule.RuleId,
+		TargetPatterns: []string{"newPattern"},
+		Priority:       5,
+		ResolvedScheme: "https",
+		PathRewrite:    &emulators.PathRewrite{Prefix: "/v1", Replacement: "/v2"},
+	}
+	_, err = s.UpdateResolveRule(nil, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := proto.Clone(rule).(*emulators.ResolveRule)
+	want.TargetPatterns = merge(dummyEmulator.Rule.TargetPatterns, rule.TargetPatterns)
+	if !proto.Equal(emu.Rule, want) {
+		t.Errorf("Expected the emulator's rule to be updated to %v: %v", want, emu.Rule)
+	}
+
+	rule.PathRewrite = &emulators.PathRewrite{Prefix: "v1", Replacement: "/v2"}
+	_, err = s.UpdateResolveRule(nil, rule)
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestUpdateResolveRule_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.UpdateResolveRule(nil, dummyEmulator.Rule)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestListResolveRules(t *testing.T) {
+	s := New()
+	resp, err := s.ListResolveRules(nil, EmptyPb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rules) != 0 {
+		t.Fatalf("Expected no rules: %s", resp.Rules)
+	}
+	ruleIds := []string{"foo", "bar"}
+	for _, id := range ruleIds {
+		_, err = s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: id})
+		if err != nil {
+			t.Fatalf("Failed to create rule %q: %v", id, err)
+		}
+	}
+	resp, err = s.ListResolveRules(nil, EmptyPb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rules) != 2 {
+		t.Fatalf("Expected 2 rules: %s", resp.Rules)
+	}
+	actualIds := []string{}
+	for _, rule := range resp.Rules {
+		actualIds = append(actualIds, rule.RuleId)
+	}
+	sort.Strings(ruleIds)
+	sort.Strings(actualIds)
+	if !reflect.DeepEqual(ruleIds, actualIds) {
+		t.Errorf("Expected %s: %s", ruleIds, actualIds)
+	}
+}
+
+func TestResolve_NoMatches(t *testing.T) {
+	s := New()
+	req := emulators.ResolveRequest{Target: "foo"}
+	resp, err := s.Resolve(nil, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Target != req.Target {
+		t.Errorf("Expected %q: %s", req.Target, resp.Target)
+	}
+}
+
+func TestResolve_EmulatorOffline(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	port, err := realEmulatorPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("localhost:%d", port)
+	if resp.Target != want {
+		t.Errorf("Wrong resolved target: %s (want: %s)", resp.Target, want)
+	}
+}
+
+func TestResolve_WhenDefaultStartDeadlineElapses(t *testing.T) {
+	b, err := startNewBroker(brokerConfigWithDeadline(1 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	realWithWait := proto.Clone(realEmulator).(*emulators.Emulator)
+	realWithWait.StartCommand.Args = append(realWithWait.StartCommand.Args, "--wait")
+	_, err = b.s.CreateEmulator(nil, realWithWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: realWithWait.Rule.TargetPatterns[0]})
+	if err == nil || grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable: %v", err)
+	}
+}
+
+// The resolve operation should wait for the start operation to complete.
+func TestResolve_EmulatorStarting(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	realWithWait := proto.Clone(realEmulator).(*emulators.Emulator)
+	realWithWait.StartCommand.Args = append(realWithWait.StartCommand.Args, "--wait")
+	_, err = b.s.CreateEmulator(nil, realWithWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the emulator, which waits to be signaled to indicate it is online.
+	// Then start the resolve.
+	emulatorId := emulators.EmulatorId{EmulatorId: realWithWait.EmulatorId}
+	startDone := make(chan bool, 1)
+	go func() {
+		_, startErr := b.s.StartEmulator(nil, &emulatorId)
+		if startErr != nil {
+			t.Fatalf("Start failed: %v", startErr)
+		}
+		startDone <- true
+	}()
+
+	resolveDone := make(chan *emulators.ResolveResponse, 1)
+	go func() {
+		waitErr := b.s.waitForStarting(realWithWait.EmulatorId, time.Now().Add(5*time.Second))
+		if waitErr != nil {
+			t.Fatal(waitErr)
+		}
+		resp, resolveErr := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realWithWait.Rule.TargetPatterns[0]})
+		if resolveErr != nil {
+			t.Fatalf("Resolve failed: %v", resolveErr)
+		}
+		resolveDone <- resp
+	}()
+
+	// Neither the start nor the resolve operation complete initially.
+	select {
+	case <-startDone:
+		t.Fatal("Start completed unexpectedly!")
+	case <-resolveDone:
+		t.Fatal("Resolve completed unexpectedly!")
+	case <-time.After(1 * time.Second):
+		break
+	}
+
+	port, err := realEmulatorPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http.Get(fmt.Sprintf("http://localhost:%d/setStatusOk", port))
+	if err != nil {
+		log.Fatal("Failed to indicate emulator has started: %v", err)
+	}
+
+	// Now the operations should complete swiftly.
+	<-startDone
+	resp := <-resolveDone
+	want := fmt.Sprintf("localhost:%d", port)
+	if resp.Target != want {
+		t.Errorf("Expected %q: %s", want, resp.Target)
+	}
+}
+
+func TestResolve_EmulatorOnline(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_ONLINE {
+		t.Fatalf("Expected emulator to be ONLINE: %s", emu.State)
+	}
+	// Now resolve again.
+	resp, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := realEmulatorPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("localhost:%d", port)
+	if resp.Target != want {
+		t.Errorf("Expected %q: %s", want, resp.Target)
+	}
+}
+
+func TestResolve_EmulatorDoesNotStartOnDemand(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Resolve(nil, &emulators.ResolveRequest{Target: dummyEmulator.Rule.TargetPatterns[0]})
+	if err == nil || grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable: %v", err)
+	}
+}
+
+func TestResolve_WithPriorityAndLongestMatch(t *testing.T) {
+	s := New()
+	rules := []*emulators.ResolveRule{
+		{RuleId: "any", TargetPatterns: []string{"example"}, ResolvedHost: "any:1"},
+		{RuleId: "longest", TargetPatterns: []string{"foo", "foo\\.example\\.com"}, ResolvedHost: "longest:1"},
+		{RuleId: "priority", TargetPatterns: []string{"bar"}, ResolvedHost: "priority:1", Priority: 1},
+	}
+	for _, rule := range rules {
+		_, err := s.CreateResolveRule(nil, rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for target, want := range map[string]string{
+		"foo.example.com":     "longest:1",
+		"bar.example.com":     "priority:1",
+		"bar.foo.example.com": "priority:1",
+		"baz.example.com":     "any:1",
+	} {
+		resp, err := s.Resolve(nil, &emulators.ResolveRequest{Target: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Target != want {
+			t.Errorf("Expected %q for %q: %q", want, target, resp.Target)
+		}
+		if resp.Candidates != nil {
+			t.Errorf("Expected no candidates without explain: %v", resp.Candidates)
+		}
+	}
+
+	resp, err := s.Resolve(nil, &emulators.ResolveRequest{Target: "bar.foo.example.com", Explain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*emulators.ResolveCandidate{
+		{RuleId: "priority", Priority: 1, TargetPattern: "bar", MatchLength: 3, Selected: true},
+		{RuleId: "longest", TargetPattern: "foo\\.example\\.com", MatchLength: 15},
+		{RuleId: "any", TargetPattern: "example", MatchLength: 7},
+	}
+	got := &emulators.ResolveResponse{Target: resp.Target, Candidates: resp.Candidates}
+	if !proto.Equal(got, &emulators.ResolveResponse{Target: "priority:1", Candidates: want}) {
+		t.Errorf("Expected %v: %v", want, resp.Candidates)
+	}
+}
+
+func TestResolve_WhenAmbiguous(t *testing.T) {
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Rules: []*emulators.ResolveRule{
+			{RuleId: "b", TargetPatterns: []string{"foo"}, ResolvedHost: "b:1"},
+			{RuleId: "a", TargetPatterns: []string{"foo"}, ResolvedHost: "a:1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// The rule with the lowest id is used.
+	resp, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Target != "a:1" {
+		t.Errorf("Expected a:1: %q", resp.Target)
+	}
+
+	b.s.rejectAmbiguousMatches = true
+	_, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: "foo"})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition: %v", err)
+	}
+	if !strings.Contains(err.Error(), `["a" "b"]`) {
+		t.Errorf("Expected the conflicting rules to be named: %v", err)
+	}
+}
+
+func TestBatchResolve(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	real2 := anotherRealEmulator("real2")
+	for _, emu := range []*emulators.Emulator{realEmulator, real2, dummyEmulator} {
+		_, err = b.s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	targets := []string{"real_service", "real2_service", "unmatched", dummyEmulator.Rule.TargetPatterns[0]}
+	req := &emulators.BatchResolveRequest{}
+	for _, target := range targets {
+		req.Requests = append(req.Requests, &emulators.ResolveRequest{Target: target})
+	}
+	resp, err := b.s.BatchResolve(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != len(targets) {
+		t.Fatalf("Expected %d results: %v", len(targets), resp.Results)
+	}
+
+	// Both emulators were started on demand.
+	for i, emu := range []*emulators.Emulator{realEmulator, real2} {
+		got, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: emu.EmulatorId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("localhost:%d", got.Ports["real"])
+		if r := resp.Results[i]; r.Code != "OK" || r.Response.Target != want {
+			t.Errorf("Expected %q for %q: %v", want, targets[i], r)
+		}
+	}
+	if r := resp.Results[2]; r.Code != "OK" || r.Response.Target != "unmatched" {
+		t.Errorf("Expected the unmatched target: %v", r)
+	}
+	if r := resp.Results[3]; r.Code != "Unavailable" || r.Error == "" || r.Response != nil {
+		t.Errorf("Expected Unavailable: %v", r)
+	}
+}
+
+func TestBatchResolve_WithMoreTargetsThanParallelism(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: "r0", TargetPatterns: []string{"^foo"}, ResolvedHost: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &emulators.BatchResolveRequest{}
+	for i := 0; i < 3*maxBatchResolveParallelism; i++ {
+		req.Requests = append(req.Requests, &emulators.ResolveRequest{Target: fmt.Sprintf("foo%d", i)})
+	}
+	resp, err := s.BatchResolve(nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != len(req.Requests) {
+		t.Fatalf("Expected %d results: %v", len(req.Requests), resp.Results)
+	}
+	for i, r := range resp.Results {
+		if r.Code != "OK" || r.Error != "" || r.Response == nil || r.Response.Target != "bar" {
+			t.Errorf("Expected bar for %q: %v", req.Requests[i].Target, r)
+		}
+	}
+}
+
+func TestResolve_WithResolvedTargetTemplate(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{
+		RuleId:                 "googleapis",
+		TargetPatterns:         []string{"(\\w+)\\.googleapis\\.com", "^empty(\\w*)$"},
+		ResolvedTargetTemplate: "${1}.local:8080",
+		PathRewrite:            &emulators.PathRewrite{Prefix: "/v1/", Replacement: "/emulator/v1/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"pubsub.googleapis.com:443":                        "pubsub.local:8080",
+		"https://datastore.googleapis.com/v1/projects/foo": "http://datastore.local:8080/emulator/v1/projects/foo",
+		"https://datastore.googleapis.com/v2/projects/foo": "http://datastore.local:8080/v2/projects/foo",
+	} {
+		resp, err := s.Resolve(nil, &emulators.ResolveRequest{Target: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Target != want {
+			t.Errorf("Expected %q for %q: %q", want, target, resp.Target)
+		}
+	}
+
+	_, err = s.Resolve(nil, &emulators.ResolveRequest{Target: "empty"})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable when the template expands to nothing: %v", err)
+	}
+}
+
+func TestCreateResolveRule_WithInvalidPathRewrite(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{
+		RuleId:      "foo",
+		PathRewrite: &emulators.PathRewrite{Prefix: "v1", Replacement: "/v2"},
+	})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestRuleIndex(t *testing.T) {
+	rules := map[string]*emulators.ResolveRule{
+		"foo":   {RuleId: "foo", TargetPatterns: []string{"foo\\.example\\.com", "^foo"}},
+		"other": {RuleId: "other", TargetPatterns: []string{"(?i)other"}},
+	}
+	x := newRuleIndex()
+	x.rebuild(rules)
+	if len(x.byPrefix["foo"]) != 2 || len(x.unkeyed) != 1 {
+		t.Errorf("Expected patterns to be keyed by their literal prefix: %v, %v", x.byPrefix, x.unkeyed)
+	}
+	matches := x.match("foo.example.com")
+	if len(matches) != 1 || matches[0].rule != rules["foo"] || matches[0].pattern != "foo\\.example\\.com" {
+		t.Fatalf("Expected the longest match of foo: %v", matches)
+	}
+	if matches := x.match("OTHER"); len(matches) != 1 || matches[0].rule != rules["other"] {
+		t.Errorf("Expected a match of other: %v", matches)
+	}
+	if matches := x.match("www.example.org/foo"); len(matches) != 0 {
+		t.Errorf("Expected no match, since ^foo is anchored: %v", matches)
+	}
+	if _, cached := x.cache["foo.example.com"]; !cached {
+		t.Errorf("Expected matches to be cached: %v", x.cache)
+	}
+
+	// Rebuilding only evicts the targets matched by added or removed
+	// patterns, and doesn't recompile known patterns.
+	compiled := x.compiled["^foo"]
+	rules["bar"] = &emulators.ResolveRule{RuleId: "bar", TargetPatterns: []string{"example"}}
+	x.rebuild(rules)
+	if _, cached := x.cache["foo.example.com"]; cached {
+		t.Errorf("Expected foo.example.com to be evicted: %v", x.cache)
+	}
+	if _, cached := x.cache["OTHER"]; !cached {
+		t.Errorf("Expected OTHER to remain cached: %v", x.cache)
+	}
+	if x.compiled["^foo"] != compiled {
+		t.Errorf("Expected ^foo not to be recompiled")
+	}
+	if matches := x.match("foo.example.com"); len(matches) != 2 {
+		t.Errorf("Expected matches of foo and bar: %v", matches)
+	}
+
+	// Changing the priority of a rule evicts the targets it matches.
+	rules["bar"].Priority = 1
+	x.rebuild(rules)
+	if matches := x.match("foo.example.com"); len(matches) != 2 || matches[0].rule != rules["bar"] {
+		t.Errorf("Expected bar to be preferred: %v", matches)
+	}
+	delete(rules, "bar")
+	x.rebuild(rules)
+	if matches := x.match("foo.example.com"); len(matches) != 1 {
+		t.Errorf("Expected bar to be gone: %v", matches)
+	}
+}
+
+func TestResolve_AfterUpdateResolveRule(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: "foo", ResolvedHost: "foo:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := s.Resolve(nil, &emulators.ResolveRequest{Target: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Target != "bar" {
+		t.Errorf("Expected no match: %q", resp.Target)
+	}
+	_, err = s.UpdateResolveRule(nil, &emulators.ResolveRule{RuleId: "foo", TargetPatterns: []string{"bar"}, ResolvedHost: "foo:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = s.Resolve(nil, &emulators.ResolveRequest{Target: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Target != "foo:1" {
+		t.Errorf("Expected foo:1 once the rule matches: %q", resp.Target)
+	}
+}
+
+func TestUpdateResolveRule_WithInvalidTargetPattern(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpdateResolveRule(nil, &emulators.ResolveRule{RuleId: "foo", TargetPatterns: []string{"("}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+}
+
+func TestCreateProxy(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := b.s.CreateProxy(nil, &emulators.Proxy{EmulatorId: realEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Port == 0 {
+		t.Fatalf("Expected a proxy port to be chosen: %v", proxy)
+	}
+
+	// The emulator starts on demand, so the first request starts it.
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", proxy.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok\n" {
+		t.Errorf("Expected ok: %q", body)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State != emulators.Emulator_ONLINE {
+		t.Errorf("Expected ONLINE: %s", emu.State)
+	}
+}
+
+func TestCreateProxy_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.CreateProxy(nil, &emulators.Proxy{EmulatorId: "foo"})
+	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
+	}
+}
+
+func TestCreateProxy_WhenAlreadyExists(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId})
 	if err == nil || grpc.Code(err) != codes.AlreadyExists {
 		t.Errorf("Expected AlreadyExists: %v", err)
 	}
 }
 
-func TestGetResolveRule_WhenNotFound(t *testing.T) {
-	s := New()
-	_, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
-	if err == nil || grpc.Code(err) != codes.NotFound {
-		t.Errorf("Expected NotFound: %v", err)
+func TestCreateProxy_WhenPortInUse(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := int32(l.Addr().(*net.TCPAddr).Port)
+	_, err = s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId, Port: port})
+	if err == nil || grpc.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable: %v", err)
+	}
+	// The proxy can be created once the port is free.
+	l.Close()
+	_, err = s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId, Port: port})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateProxy_WhenNoResolvedHost(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/", proxy.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d: %s", http.StatusServiceUnavailable, resp.Status)
+	}
+}
+
+func TestDeleteEmulator(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId}
+	_, err = s.DeleteEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetEmulator(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+	_, err = s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+	_, err = s.GetProxy(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+	// The emulator can be created again.
+	_, err = s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteEmulator_WhenOnline(t *testing.T) {
+	b, err := startNewBroker(brokerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu := b.s.emulators[realEmulator.EmulatorId]
+	_, err = b.s.DeleteEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emu.State() != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected OFFLINE: %s", emu.State())
+	}
+	_, err = b.s.GetEmulator(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestDeleteEmulator_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.DeleteEmulator(nil, &emulators.EmulatorId{EmulatorId: "foo"})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestDeleteResolveRule(t *testing.T) {
+	s := New()
+	_, err := s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DeleteResolveRule(nil, &emulators.ResolveRuleId{RuleId: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: "foo"})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestDeleteResolveRule_WhenNotFound(t *testing.T) {
+	s := New()
+	_, err := s.DeleteResolveRule(nil, &emulators.ResolveRuleId{RuleId: "foo"})
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestDeleteResolveRule_WhenOwnedByEmulator(t *testing.T) {
+	s := New()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DeleteResolveRule(nil, &emulators.ResolveRuleId{RuleId: dummyEmulator.Rule.RuleId})
+	if err == nil || grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
+	}
+}
+
+func TestDeleteProxy(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: dummyEmulator.EmulatorId}
+	proxy, err := s.CreateProxy(nil, &emulators.Proxy{EmulatorId: dummyEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DeleteProxy(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = http.Get(fmt.Sprintf("http://localhost:%d/", proxy.Port))
+	if err == nil {
+		t.Errorf("Expected the proxy port to be closed")
+	}
+	_, err = s.GetEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Errorf("Expected the emulator to remain: %v", err)
+	}
+	_, err = s.DeleteProxy(nil, &emulatorId)
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+func TestListPortAllocations(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	_, err = b.s.CreateEmulator(nil, realEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := b.s.CreateProxy(nil, &emulators.Proxy{EmulatorId: realEmulator.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := realEmulatorPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.s.ListPortAllocations(nil, EmptyPb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[int32]string)
+	for _, a := range resp.Allocations {
+		got[a.Port] = fmt.Sprintf("%s/%s/%s", a.OwnerType, a.OwnerId, a.PortName)
+	}
+	want := map[int32]string{
+		int32(port): "EMULATOR/real/real",
+		proxy.Port:  "PROXY/real/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v: %v", want, got)
+	}
+
+	// Stopping the emulator and deleting the proxy releases the ports.
+	_, err = b.s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.DeleteProxy(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.s.ListPortAllocations(nil, EmptyPb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Allocations) != 0 {
+		t.Errorf("Expected no allocations: %v", resp.Allocations)
+	}
+}
+
+// Watches emulators through a client connection, and waits until the broker
+// has registered the watcher.
+func watchEmulators(ctx context.Context, b *grpcServer, conn *ClientConnection, emulatorId string) (emulators.Broker_WatchEmulatorsClient, error) {
+	b.s.mu.Lock()
+	watchers := len(b.s.watchers)
+	b.s.mu.Unlock()
+	stream, err := conn.BrokerClient.WatchEmulators(ctx, &emulators.WatchEmulatorsRequest{EmulatorId: emulatorId})
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.s.mu.Lock()
+		registered := len(b.s.watchers) > watchers
+		b.s.mu.Unlock()
+		if registered {
+			return stream, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("watcher was not registered")
+}
+
+func TestWatchEmulators(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	real2 := anotherRealEmulator("real2")
+	for _, emu := range []*emulators.Emulator{realEmulator, real2} {
+		_, err = b.s.CreateEmulator(nil, emu)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := NewClientConnection(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := watchEmulators(ctx, b, conn, realEmulator.EmulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events of other emulators are filtered out.
+	_, err = b.s.StartEmulator(nil, &emulators.EmulatorId{EmulatorId: real2.EmulatorId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.s.StopEmulator(nil, &emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var states []emulators.Emulator_State
+	var resolvedHosts []string
+	exited := false
+	for len(states) == 0 || states[len(states)-1] != emulators.Emulator_OFFLINE {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive events (got states %v): %v", states, err)
+		}
+		if event.EmulatorId != realEmulator.EmulatorId {
+			t.Errorf("Expected only events of %q: %v", realEmulator.EmulatorId, event)
+		}
+		switch event.Type {
+		case emulators.EmulatorEvent_STATE_CHANGED:
+			states = append(states, event.Emulator.State)
+		case emulators.EmulatorEvent_RESOLVED_HOST_CHANGED:
+			resolvedHosts = append(resolvedHosts, event.Emulator.Rule.ResolvedHost)
+		case emulators.EmulatorEvent_EXITED:
+			exited = true
+		}
+	}
+	wantStates := []emulators.Emulator_State{
+		emulators.Emulator_STARTING,
+		emulators.Emulator_ONLINE,
+		emulators.Emulator_STOPPING,
+		emulators.Emulator_OFFLINE,
+	}
+	if !reflect.DeepEqual(states, wantStates) {
+		t.Errorf("Expected states %v: %v", wantStates, states)
+	}
+	if len(resolvedHosts) != 2 || resolvedHosts[0] == "" || resolvedHosts[1] != "" {
+		t.Errorf("Expected the resolved host to be set, then retracted: %v", resolvedHosts)
+	}
+	if !exited {
+		t.Error("Expected an EXITED event")
+	}
+}
+
+func TestWatchEmulators_WhenNotFound(t *testing.T) {
+	b, err := startNewBroker(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	conn, err := NewClientConnection(1 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.BrokerClient.WatchEmulators(ctx,
+		&emulators.WatchEmulatorsRequest{EmulatorId: dummyEmulator.EmulatorId})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err == nil || grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
+
+// A WatchEmulators stream whose Send blocks until the event is received from
+// the sent channel.
+type blockingWatchStream struct {
+	emulators.Broker_WatchEmulatorsServer
+	ctx  context.Context
+	sent chan *emulators.EmulatorEvent
+}
+
+func (s *blockingWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *blockingWatchStream) Send(event *emulators.EmulatorEvent) error {
+	s.sent <- event
+	return nil
+}
+
+func TestWatchEmulators_WhenFallingBehind(t *testing.T) {
+	s := New()
+	defer s.Clear()
+	_, err := s.CreateEmulator(nil, dummyEmulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := &blockingWatchStream{ctx: ctx, sent: make(chan *emulators.EmulatorEvent)}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchEmulators(&emulators.WatchEmulatorsRequest{}, stream)
+	}()
+	for watching := false; !watching; {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		watching = len(s.watchers) > 0
+		s.mu.Unlock()
+	}
+
+	// The watcher blocks on sending the first event, while the others are
+	// queued.
+	publish := func() {
+		s.mu.Lock()
+		s.publishEvent(&emulators.EmulatorEvent{EmulatorId: dummyEmulator.EmulatorId})
+		s.mu.Unlock()
+	}
+	publish()
+	for taken := false; !taken; {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		for w := range s.watchers {
+			taken = len(w.events) == 0
+		}
+		s.mu.Unlock()
+	}
+	for i := 0; i < maxWatcherEvents+10; i++ {
+		publish()
+	}
+	// The queued events are sent before the stream is closed.
+	received := 0
+	for {
+		select {
+		case <-stream.sent:
+			received++
+			continue
+		case err = <-done:
+		case <-ctx.Done():
+			t.Fatal("Expected the stream to be closed")
+		}
+		break
+	}
+	if err == nil || grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted: %v", err)
+	}
+	if received != maxWatcherEvents+1 {
+		t.Errorf("Expected %d events: %d", maxWatcherEvents+1, received)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.watchers) != 0 {
+		t.Errorf("Expected the watcher to be removed: %d", len(s.watchers))
+	}
+}
+
+// Returns the method, resource id and code of each event, e.g.
+// "StartEmulator/real/OK".
+func describeEvents(events []*emulators.BrokerEvent) []string {
+	var descs []string
+	for _, e := range events {
+		descs = append(descs, fmt.Sprintf("%s/%s/%s", e.Method, e.ResourceId, e.Code))
 	}
+	return descs
 }
 
-func TestUpdateResolveRule(t *testing.T) {
-	s := New()
-	rule := *dummyEmulator.Rule
-	_, err := s.CreateResolveRule(nil, &rule)
+func TestListEvents(t *testing.T) {
+	journalFile := filepath.Join(tmpDir, "journal", "events.jsonl")
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Emulators:        []*emulators.Emulator{dummyEmulator},
+		EventJournalFile: journalFile,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Specify just a single pattern. This should get merged with the existing
-	// ones.
-	rule.TargetPatterns = []string{"newPattern"}
-	updateResp, err := s.UpdateResolveRule(nil, &rule)
+	defer b.Shutdown()
+
+	conn, err := NewClientConnection(1 * time.Second)
 	if err != nil {
-		t.Fatalf("Failed to update rule: %v", err)
+		t.Fatal(err)
 	}
-	getResp, err := s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: rule.RuleId})
-	if err != nil {
-		t.Fatalf("Failed to get rule: %v", err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = conn.BrokerClient.StartEmulator(ctx, &emulators.EmulatorId{EmulatorId: "missing"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound: %v", err)
 	}
-	if !proto.Equal(updateResp, getResp) {
-		t.Fatalf("Expected %v: %v", getResp, updateResp)
+	_, err = conn.BrokerClient.CreateResolveRule(ctx, &emulators.ResolveRule{RuleId: "rule"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	patterns := merge(dummyEmulator.Rule.TargetPatterns, rule.TargetPatterns)
-	if !unorderedEqual(getResp.TargetPatterns, patterns) {
-		t.Fatalf("Expected %v: %v", patterns, getResp.TargetPatterns)
+	// Reads are not recorded.
+	_, err = conn.BrokerClient.GetResolveRule(ctx, &emulators.ResolveRuleId{RuleId: "rule"})
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestUpdateResolveRule_WhenNotFound(t *testing.T) {
-	s := New()
-	_, err := s.UpdateResolveRule(nil, dummyEmulator.Rule)
-	if err == nil || grpc.Code(err) != codes.NotFound {
-		t.Errorf("Expected NotFound: %v", err)
+	resp, err := b.s.ListEvents(nil, &emulators.ListEventsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"CreateEmulator/" + dummyEmulator.EmulatorId + "/OK",
+		"StartEmulator/missing/NotFound",
+		"CreateResolveRule/rule/OK",
+	}
+	if got := describeEvents(resp.Events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	if resp.Events[0].Peer != "" {
+		t.Errorf("Expected no peer for the config: %v", resp.Events[0])
+	}
+	if resp.Events[1].Peer == "" || resp.Events[1].Error == "" {
+		t.Errorf("Expected a peer and an error: %v", resp.Events[1])
 	}
-}
 
-func TestListResolveRules(t *testing.T) {
-	s := New()
-	resp, err := s.ListResolveRules(nil, EmptyPb)
+	resp, err = b.s.ListEvents(nil, &emulators.ListEventsRequest{ResourceId: "rule"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Rules) != 0 {
-		t.Fatalf("Expected no rules: %s", resp.Rules)
+	if got := describeEvents(resp.Events); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("Expected %v: %v", want[2:], got)
 	}
-	ruleIds := []string{"foo", "bar"}
-	for _, id := range ruleIds {
-		_, err = s.CreateResolveRule(nil, &emulators.ResolveRule{RuleId: id})
+	resp, err = b.s.ListEvents(nil, &emulators.ListEventsRequest{Tail: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describeEvents(resp.Events); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("Expected %v: %v", want[1:], got)
+	}
+
+	// Every event is also written to the journal file.
+	contents, err := ioutil.ReadFile(journalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*emulators.BrokerEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		event := &emulators.BrokerEvent{}
+		err = jsonpb.UnmarshalString(line, event)
 		if err != nil {
-			t.Fatalf("Failed to create rule %q: %v", id, err)
+			t.Fatalf("Failed to parse %q: %v", line, err)
 		}
+		events = append(events, event)
 	}
-	resp, err = s.ListResolveRules(nil, EmptyPb)
+	if got := describeEvents(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v in %s: %v", want, journalFile, got)
+	}
+}
+
+func TestEventJournal_DiscardsOldEvents(t *testing.T) {
+	j, err := newEventJournal(2, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(resp.Rules) != 2 {
-		t.Fatalf("Expected 2 rules: %s", resp.Rules)
+	for _, id := range []string{"a", "b", "c"} {
+		j.record(&emulators.BrokerEvent{Method: "StopEmulator", ResourceId: id, Code: "OK"})
 	}
-	actualIds := []string{}
-	for _, rule := range resp.Rules {
-		actualIds = append(actualIds, rule.RuleId)
+	want := []string{"StopEmulator/b/OK", "StopEmulator/c/OK"}
+	if got := describeEvents(j.list("", time.Time{}, 0)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v: %v", want, got)
 	}
-	sort.Strings(ruleIds)
-	sort.Strings(actualIds)
-	if !reflect.DeepEqual(ruleIds, actualIds) {
-		t.Errorf("Expected %s: %s", ruleIds, actualIds)
+}
+
+// Returns the code of each result, by emulator id, and whether it was rolled
+// back, e.g. "OK (rolled back)".
+func describeGroupResults(resp *emulators.GroupResponse) map[string]string {
+	descs := make(map[string]string)
+	for _, r := range resp.Results {
+		descs[r.EmulatorId] = r.Code
+		if r.RolledBack {
+			descs[r.EmulatorId] += " (rolled back)"
+		}
 	}
+	return descs
 }
 
-func TestResolve_NoMatches(t *testing.T) {
-	s := New()
-	req := emulators.ResolveRequest{Target: "foo"}
-	resp, err := s.Resolve(nil, &req)
+func TestStartGroup(t *testing.T) {
+	app := anotherRealEmulator("app")
+	app.DependsOn = []string{realEmulator.EmulatorId}
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{realEmulator, app},
+		Groups: []*emulators.EmulatorGroup{
+			{GroupId: "full", EmulatorIds: []string{"app", "real"}},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.Target != req.Target {
-		t.Errorf("Expected %q: %s", req.Target, resp.Target)
+	defer b.Shutdown()
+
+	resp, err := b.s.StartGroup(nil, &emulators.GroupId{GroupId: "full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app": "OK", "real": "OK"}
+	if got := describeGroupResults(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	for _, id := range []string{"app", "real"} {
+		emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if emu.State != emulators.Emulator_ONLINE {
+			t.Errorf("Expected %q to be ONLINE: %s", id, emu.State)
+		}
+	}
+
+	// The dependent is stopped before its dependency, so no cascade is needed.
+	resp, err = b.s.StopGroup(nil, &emulators.StopGroupRequest{GroupId: "full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describeGroupResults(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	for _, id := range []string{"app", "real"} {
+		emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if emu.State != emulators.Emulator_OFFLINE {
+			t.Errorf("Expected %q to be OFFLINE: %s", id, emu.State)
+		}
 	}
 }
 
-func TestResolve_EmulatorOffline(t *testing.T) {
-	b, err := startNewBroker(brokerConfig)
+func TestStartGroup_RollsBackOnFailure(t *testing.T) {
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{realEmulator},
+		Groups: []*emulators.EmulatorGroup{
+			{GroupId: "broken", EmulatorIds: []string{"real", "missing"}},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer b.Shutdown()
 
-	_, err = b.s.CreateEmulator(nil, realEmulator)
+	resp, err := b.s.StartGroup(nil, &emulators.GroupId{GroupId: "broken"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
-	if err != nil {
-		t.Fatalf("Resolve failed: %v", err)
+	want := map[string]string{"real": "OK (rolled back)", "missing": "NotFound"}
+	if got := describeGroupResults(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
 	}
-	port, err := realEmulatorPort(b)
+	emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId})
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := fmt.Sprintf("localhost:%d", port)
-	if resp.Target != want {
-		t.Errorf("Wrong resolved target: %s (want: %s)", resp.Target, want)
+	if emu.State != emulators.Emulator_OFFLINE {
+		t.Errorf("Expected the emulator to be rolled back: %s", emu.State)
+	}
+	if err := b.StartGroup("broken"); err == nil {
+		t.Error("Expected an error")
 	}
 }
 
-func TestResolve_WhenDefaultStartDeadlineElapses(t *testing.T) {
-	b, err := startNewBroker(brokerConfigWithDeadline(1 * time.Second))
+func TestStartGroup_RollsBackDependencies(t *testing.T) {
+	app := anotherRealEmulator("app")
+	app.DependsOn = []string{realEmulator.EmulatorId}
+	real2 := anotherRealEmulator("real2")
+	broken := anotherRealEmulator("broken")
+	broken.StartCommand.Path = "/nonexistent/emulator"
+	broken.DependsOn = []string{real2.EmulatorId}
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{realEmulator, real2, app, broken},
+		Groups: []*emulators.EmulatorGroup{
+			{GroupId: "apps", EmulatorIds: []string{"app", "broken"}},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer b.Shutdown()
 
-	realWithWait := proto.Clone(realEmulator).(*emulators.Emulator)
-	realWithWait.StartCommand.Args = append(realWithWait.StartCommand.Args, "--wait")
-	_, err = b.s.CreateEmulator(nil, realWithWait)
+	resp, err := b.s.StartGroup(nil, &emulators.GroupId{GroupId: "apps"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: realWithWait.Rule.TargetPatterns[0]})
-	if err == nil || grpc.Code(err) != codes.Unavailable {
-		t.Errorf("Expected Unavailable: %v", err)
+	want := map[string]string{"app": "OK (rolled back)", "broken": "Unknown"}
+	if got := describeGroupResults(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	// The dependencies started for the group, including those of the member
+	// that failed, are stopped too.
+	for _, id := range []string{"app", "real", "real2", "broken"} {
+		emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if emu.State != emulators.Emulator_OFFLINE {
+			t.Errorf("Expected %q to be rolled back: %s", id, emu.State)
+		}
 	}
 }
 
-// The resolve operation should wait for the start operation to complete.
-func TestResolve_EmulatorStarting(t *testing.T) {
-	b, err := startNewBroker(brokerConfig)
+func TestCreateGroup(t *testing.T) {
+	s := New()
+	group := &emulators.EmulatorGroup{GroupId: "storage", EmulatorIds: []string{"datastore", "gcs"}}
+	_, err := s.CreateGroup(nil, group)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer b.Shutdown()
-
-	realWithWait := proto.Clone(realEmulator).(*emulators.Emulator)
-	realWithWait.StartCommand.Args = append(realWithWait.StartCommand.Args, "--wait")
-	_, err = b.s.CreateEmulator(nil, realWithWait)
+	got, err := s.GetGroup(nil, &emulators.GroupId{GroupId: "storage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, group) {
+		t.Errorf("Expected %v: %v", group, got)
+	}
+	_, err = s.CreateGroup(nil, group)
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists: %v", err)
+	}
+	_, err = s.CreateGroup(nil, &emulators.EmulatorGroup{GroupId: "dup", EmulatorIds: []string{"gcs", "gcs"}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument: %v", err)
+	}
+	_, err = s.DeleteGroup(nil, &emulators.GroupId{GroupId: "storage"})
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = s.StartGroup(nil, &emulators.GroupId{GroupId: "storage"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound: %v", err)
+	}
+}
 
-	// Start the emulator, which waits to be signaled to indicate it is online.
-	// Then start the resolve.
-	emulatorId := emulators.EmulatorId{EmulatorId: realWithWait.EmulatorId}
-	startDone := make(chan bool, 1)
-	go func() {
-		_, startErr := b.s.StartEmulator(nil, &emulatorId)
-		if startErr != nil {
-			t.Fatalf("Start failed: %v", startErr)
-		}
-		startDone <- true
-	}()
+func describeConfigChanges(resp *emulators.ReloadConfigResponse) map[string]string {
+	descs := make(map[string]string)
+	for _, c := range resp.Changes {
+		descs[c.Kind+" "+c.Id] = c.Action.String() + " " + c.Code
+	}
+	return descs
+}
 
-	resolveDone := make(chan *emulators.ResolveResponse, 1)
-	go func() {
-		waitErr := b.s.waitForStarting(realWithWait.EmulatorId, time.Now().Add(5*time.Second))
-		if waitErr != nil {
-			t.Fatal(waitErr)
-		}
-		resp, resolveErr := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realWithWait.Rule.TargetPatterns[0]})
-		if resolveErr != nil {
-			t.Fatalf("Resolve failed: %v", resolveErr)
-		}
-		resolveDone <- resp
-	}()
+func TestReloadConfig(t *testing.T) {
+	b, err := startNewBroker(&emulators.BrokerConfig{
+		Emulators: []*emulators.Emulator{dummyEmulator, realEmulator},
+		Rules: []*emulators.ResolveRule{
+			{RuleId: "r1", TargetPatterns: []string{"r1_service"}},
+		},
+		Groups: []*emulators.EmulatorGroup{
+			{GroupId: "g", EmulatorIds: []string{"dummy"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
 
-	// Neither the start nor the resolve operation complete initially.
-	select {
-	case <-startDone:
-		t.Fatal("Start completed unexpectedly!")
-	case <-resolveDone:
-		t.Fatal("Resolve completed unexpectedly!")
-	case <-time.After(1 * time.Second):
-		break
+	changed := proto.Clone(realEmulator).(*emulators.Emulator)
+	changed.StartOnDemand = false
+	reloaded := &emulators.BrokerConfig{
+		PortRanges:             []*emulators.PortRange{{Begin: 10000, End: 10100}},
+		RejectAmbiguousMatches: true,
+		Emulators:              []*emulators.Emulator{dummyEmulator, changed, anotherRealEmulator("real2")},
+		Rules: []*emulators.ResolveRule{
+			{RuleId: "r1", TargetPatterns: []string{"r1_service", "r1_other"}},
+			{RuleId: "r2", TargetPatterns: []string{"r2_service"}},
+			// Owned by the dummy emulator.
+			{RuleId: "dummy_rule", TargetPatterns: []string{"pattern1"}},
+		},
+		Groups: []*emulators.EmulatorGroup{
+			{GroupId: "g", EmulatorIds: []string{"dummy", "real"}},
+			{GroupId: "g2", EmulatorIds: []string{"real2"}},
+		},
 	}
+	b.SetConfigLoader(func() (*emulators.BrokerConfig, error) {
+		return reloaded, nil
+	})
 
-	port, err := realEmulatorPort(b)
+	resp, err := b.ReloadConfig(false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	http.Get(fmt.Sprintf("http://localhost:%d/setStatusOk", port))
+	want := map[string]string{
+		"setting reject_ambiguous_matches": "UPDATED OK",
+		"setting port_ranges":              "REJECTED FailedPrecondition",
+		"emulator real":                    "UPDATED OK",
+		"emulator real2":                   "ADDED OK",
+		"rule r1":                          "UPDATED OK",
+		"rule r2":                          "ADDED OK",
+		"rule dummy_rule":                  "REJECTED FailedPrecondition",
+		"group g":                          "UPDATED OK",
+		"group g2":                         "ADDED OK",
+	}
+	if got := describeConfigChanges(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	emu, err := b.s.GetEmulator(nil, &emulators.EmulatorId{EmulatorId: "real"})
 	if err != nil {
-		log.Fatal("Failed to indicate emulator has started: %v", err)
+		t.Fatal(err)
+	}
+	if emu.StartOnDemand {
+		t.Errorf("Expected emulator to be updated: %v", emu)
+	}
+	rule, err := b.s.GetResolveRule(nil, &emulators.ResolveRuleId{RuleId: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rule.TargetPatterns, []string{"r1_service", "r1_other"}) {
+		t.Errorf("Expected rule to be updated: %v", rule)
 	}
 
-	// Now the operations should complete swiftly.
-	<-startDone
-	resp := <-resolveDone
-	want := fmt.Sprintf("localhost:%d", port)
-	if resp.Target != want {
-		t.Errorf("Expected %q: %s", want, resp.Target)
+	// Reloading the same config again only rejects the same setting.
+	resp, err = b.ReloadConfig(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"setting port_ranges": "REJECTED FailedPrecondition"}
+	if got := describeConfigChanges(resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v: %v", want, got)
 	}
 }
 
-func TestResolve_EmulatorOnline(t *testing.T) {
-	b, err := startNewBroker(brokerConfig)
+func TestReloadConfig_WhenEmulatorRunning(t *testing.T) {
+	b, err := startNewBroker(&emulators.BrokerConfig{Emulators: []*emulators.Emulator{realEmulator}})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer b.Shutdown()
+	emulatorId := &emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
+	_, err = b.s.StartEmulator(nil, emulatorId)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_, err = b.s.CreateEmulator(nil, realEmulator)
+	changed := proto.Clone(realEmulator).(*emulators.Emulator)
+	changed.Rule.TargetPatterns = []string{"real_service", "other_service"}
+	b.SetConfigLoader(func() (*emulators.BrokerConfig, error) {
+		return &emulators.BrokerConfig{Emulators: []*emulators.Emulator{changed}}, nil
+	})
+
+	resp, err := b.ReloadConfig(false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
+	want := map[string]string{"emulator real": "REJECTED FailedPrecondition"}
+	if got := describeConfigChanges(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
+	}
+	resolved, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: "other_service"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	emulatorId := emulators.EmulatorId{EmulatorId: realEmulator.EmulatorId}
-	emu, err := b.s.GetEmulator(nil, &emulatorId)
+	if resolved.Target != "other_service" {
+		t.Errorf("Expected no rule to match: %v", resolved)
+	}
+
+	resp, err = b.ReloadConfig(true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if emu.State != emulators.Emulator_ONLINE {
-		t.Fatalf("Expected emulator to be ONLINE: %s", emu.State)
+	want = map[string]string{"emulator real": "RESTARTED OK"}
+	if got := describeConfigChanges(resp); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v: %v", want, got)
 	}
-	// Now resolve again.
-	resp, err := b.s.Resolve(nil, &emulators.ResolveRequest{Target: realEmulator.Rule.TargetPatterns[0]})
+	emu, err := b.s.GetEmulator(nil, emulatorId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	port, err := realEmulatorPort(b)
+	if emu.State != emulators.Emulator_ONLINE {
+		t.Errorf("Expected ONLINE: %s", emu.State)
+	}
+	resolved, err = b.s.Resolve(nil, &emulators.ResolveRequest{Target: "other_service"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := fmt.Sprintf("localhost:%d", port)
-	if resp.Target != want {
-		t.Errorf("Expected %q: %s", want, resp.Target)
+	if resolved.Target == "other_service" {
+		t.Errorf("Expected the emulator's rule to match: %v", resolved)
 	}
 }
 
-func TestResolve_EmulatorDoesNotStartOnDemand(t *testing.T) {
+func TestReloadConfig_WithoutConfigFile(t *testing.T) {
 	s := New()
-	_, err := s.CreateEmulator(nil, dummyEmulator)
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = s.Resolve(nil, &emulators.ResolveRequest{Target: dummyEmulator.Rule.TargetPatterns[0]})
-	if err == nil || grpc.Code(err) != codes.Unavailable {
-		t.Errorf("Expected Unavailable: %v", err)
+	_, err := s.ReloadConfig(nil, &emulators.ReloadConfigRequest{})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition: %v", err)
 	}
 }
@@ -33,6 +33,8 @@ import (
 	"time"
 
 	glog "github.com/golang/glog"
+	duration_pb "github.com/golang/protobuf/ptypes/duration"
+	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
 	http2 "golang.org/x/net/http2"
 	emulators "google/emulators"
 )
@@ -71,24 +73,70 @@ type PortPicker interface {
 	Next() (int, error)
 }
 
-// Picks ports from a list of non-overlapping PortRange values.
+// PortReleaser is implemented by a PortPicker that tracks the ports it picked.
+type PortReleaser interface {
+	// Returns a port obtained from Next(), which is no longer used, so that it
+	// may be picked again.
+	Release(port int)
+}
+
+// Picks ports from a list of non-overlapping PortRange values. Ports are
+// considered in order, wrapping around to the beginning of the first range
+// once all ranges have been walked. Ports that were picked and not yet
+// released are skipped, as are ports that cannot be bound, e.g. because they
+// are held by other processes.
 type PortRangePicker struct {
 	ranges []*emulators.PortRange
 	rIndex int
 	last   int
+	inUse  map[int]bool
+	// Returns whether the port is free. Replaced in tests.
+	isFree func(port int) bool
 }
 
 func (p *PortRangePicker) Next() (int, error) {
-	if p.last == -1 || p.last+1 >= int(p.ranges[p.rIndex].End) {
-		if p.rIndex >= len(p.ranges)-1 {
-			return -1, fmt.Errorf("Exhausted all ranges")
+	size := 0
+	for _, r := range p.ranges {
+		size += int(r.End - r.Begin)
+	}
+	for i := 0; i < size; i++ {
+		port := p.advance()
+		if p.inUse[port] {
+			continue
 		}
-		p.rIndex++
+		if !p.isFree(port) {
+			glog.V(1).Infof("Skipping port %d, which is not free", port)
+			continue
+		}
+		p.inUse[port] = true
+		return port, nil
+	}
+	return -1, fmt.Errorf("Exhausted all ranges")
+}
+
+// Moves to the next port in the ranges, wrapping around, and returns it.
+func (p *PortRangePicker) advance() int {
+	if p.rIndex == -1 || p.last+1 >= int(p.ranges[p.rIndex].End) {
+		p.rIndex = (p.rIndex + 1) % len(p.ranges)
 		p.last = int(p.ranges[p.rIndex].Begin)
 	} else {
 		p.last++
 	}
-	return p.last, nil
+	return p.last
+}
+
+func (p *PortRangePicker) Release(port int) {
+	delete(p.inUse, port)
+}
+
+// Returns whether the port can be bound on localhost.
+func portIsFree(port int) bool {
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return false
+	}
+	lis.Close()
+	return true
 }
 
 // Implements sort.Interface for []emulators.PortRange based on Begin.
@@ -115,7 +163,7 @@ func NewPortRangePicker(ranges []*emulators.PortRange) (*PortRangePicker, error)
 			}
 		}
 	}
-	return &PortRangePicker{ranges: ranges, rIndex: -1, last: -1}, nil
+	return &PortRangePicker{ranges: ranges, rIndex: -1, last: -1, inUse: make(map[int]bool), isFree: portIsFree}, nil
 }
 
 type FreePortPicker struct{}
@@ -135,6 +183,27 @@ func (p *FreePortPicker) Next() (int, error) {
 	return lis.Addr().(*net.TCPAddr).Port, nil
 }
 
+// Converts d to a time.Duration, or returns def if d is not specified.
+func toDuration(d *duration_pb.Duration, def time.Duration) time.Duration {
+	if d == nil {
+		return def
+	}
+	return time.Duration(d.Seconds)*time.Second + time.Duration(d.Nanos)*time.Nanosecond
+}
+
+// Converts t to a Timestamp.
+func toTimestamp(t time.Time) *timestamp_pb.Timestamp {
+	return &timestamp_pb.Timestamp{Seconds: t.Unix(), Nanos: int32(t.Nanosecond())}
+}
+
+// Converts ts to a time.Time, or returns the zero time if ts is not specified.
+func fromTimestamp(ts *timestamp_pb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos))
+}
+
 // Returns the combined contents of a and b, with no duplicates.
 func merge(a []string, b []string) []string {
 	values := make(map[string]bool)
@@ -185,6 +254,9 @@ func (w *prettyJsonWriter) WriteHeader(code int) {
 	w.delegate.WriteHeader(code)
 }
 
+// Writes the buffered content to the delegate, and flushes the delegate if
+// possible. Streaming handlers flush after every message, so each message is
+// formatted, and delivered, separately.
 func (w *prettyJsonWriter) Flush() {
 	var indented bytes.Buffer
 	src, _ := ioutil.ReadAll(&w.buf)
@@ -192,10 +264,13 @@ func (w *prettyJsonWriter) Flush() {
 	if err != nil {
 		// Content might not be Json. Just write it as-is.
 		w.delegate.Write(src)
-		return
+	} else {
+		indented.WriteString("\n")
+		w.delegate.Write(indented.Bytes())
+	}
+	if f, ok := w.delegate.(http.Flusher); ok {
+		f.Flush()
 	}
-	indented.WriteString("\n")
-	w.delegate.Write(indented.Bytes())
 }
 
 // An http.Handler that formats Json content for human-readability.
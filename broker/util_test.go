@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"net"
 	"reflect"
 	"testing"
 
@@ -44,6 +45,8 @@ func TestPortRangePicker(t *testing.T) {
 			t.Errorf("Unexpected failure creating picker for %v: %v", c, err)
 			continue
 		}
+		// Low ports cannot be bound without privileges.
+		p.isFree = func(int) bool { return true }
 		var ports []int
 		for true {
 			port, err := p.Next()
@@ -57,3 +60,92 @@ func TestPortRangePicker(t *testing.T) {
 		}
 	}
 }
+
+func TestPortRangePicker_Release(t *testing.T) {
+	p, err := NewPortRangePicker([]*e.PortRange{&e.PortRange{1, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.isFree = func(int) bool { return true }
+	var ports []int
+	for i := 0; i < 2; i++ {
+		port, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports = append(ports, port)
+	}
+	_, err = p.Next()
+	if err == nil {
+		t.Fatal("Expected the range to be exhausted")
+	}
+	// Released ports are picked again.
+	p.Release(ports[1])
+	port, err := p.Next()
+	if err != nil || port != ports[1] {
+		t.Errorf("Expected port %d: %d, %v", ports[1], port, err)
+	}
+	_, err = p.Next()
+	if err == nil {
+		t.Error("Expected the range to be exhausted again")
+	}
+}
+
+// A PortPicker that doesn't implement PortReleaser.
+type countingPortPicker struct {
+	next int
+}
+
+func (p *countingPortPicker) Next() (int, error) {
+	p.next++
+	return p.next, nil
+}
+
+func TestPortAllocator_WithoutPortReleaser(t *testing.T) {
+	a := newPortAllocator(&countingPortPicker{})
+	port, err := a.allocate(e.PortAllocation_EMULATOR, "foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lease ends, even though the picker can't take the port back.
+	a.release(port)
+	if _, leased := a.leases[port]; leased {
+		t.Errorf("Expected port %d to be released", port)
+	}
+}
+
+func TestPortRangePicker_WhenPortsAreNotFree(t *testing.T) {
+	p, err := NewPortRangePicker([]*e.PortRange{&e.PortRange{1, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.isFree = func(port int) bool { return port != 2 }
+	var ports []int
+	for true {
+		port, err := p.Next()
+		if err != nil {
+			break
+		}
+		ports = append(ports, port)
+	}
+	if !reflect.DeepEqual(ports, []int{1, 3, 4}) {
+		t.Errorf("Expected [1 3 4]: %v", ports)
+	}
+}
+
+func TestPortRangePicker_WhenPortIsBound(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	bound := int32(lis.Addr().(*net.TCPAddr).Port)
+	p, err := NewPortRangePicker([]*e.PortRange{&e.PortRange{bound, bound + 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := p.Next()
+	if err == nil {
+		t.Errorf("Expected bound port %d to be skipped: %d", bound, port)
+	}
+}
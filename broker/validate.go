@@ -0,0 +1,343 @@
+/*
+Copyright 2016 Google Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	re "regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	emulators "google/emulators"
+)
+
+var (
+	// Matches the beginning of special tokens, whether well-formed or not.
+	tokenStartMatcher = re.MustCompile("{(port|env|host|dir):")
+	// Matches the well-formed special tokens, by kind.
+	tokenMatchers = map[string]*re.Regexp{
+		"port": portMatcher,
+		"env":  envMatcher,
+		"host": hostMatcher,
+		"dir":  re.MustCompile("{dir:broker}"),
+	}
+)
+
+// ValidateConfig checks the config as a whole, and returns all of its
+// problems, while NewGrpcServer stops at the first one. It also returns the
+// emulators in the order they would be started, with their start commands
+// expanded as the broker would run them, and warnings about what the broker
+// accepts but may not be intended, e.g. environment variables that are not
+// set. Ports are picked from the port ranges of the config, and
+// "{dir:broker}" tokens are expanded to brokerDir.
+func ValidateConfig(config *emulators.BrokerConfig, brokerDir string) ([]*emulators.Emulator, []string, []string) {
+	var problems []string
+	report := func(err error) {
+		problems = append(problems, grpc.ErrorDesc(err))
+	}
+
+	// A scratch server, which checks each resource when it is created.
+	s := New()
+	s.expander.brokerDir = brokerDir
+	if len(config.PortRanges) > 0 {
+		// The picker sorts the ranges in place.
+		ranges := append([]*emulators.PortRange(nil), config.PortRanges...)
+		picker, err := NewPortRangePicker(ranges)
+		if err != nil {
+			report(err)
+		} else {
+			s.expander.allocator.picker = picker
+		}
+	}
+	var ids []string
+	var warnings []string
+	for _, e := range config.Emulators {
+		problems = append(problems, checkTokens(e)...)
+		warnings = append(warnings, unsetEnvVariables(e)...)
+		if emulatorProblems := s.emulatorProblems(e); len(emulatorProblems) > 0 {
+			for _, err := range emulatorProblems {
+				report(err)
+			}
+		} else if _, err := s.CreateEmulator(nil, e); err != nil {
+			report(err)
+		} else {
+			ids = append(ids, e.EmulatorId)
+			continue
+		}
+		// The command of an emulator that can't be created is not expanded,
+		// so it is checked if it has no special tokens.
+		if command := e.StartCommand; command != nil && command.Path != "" && !tokenStartMatcher.MatchString(command.Path) {
+			if err := checkExecutable(command); err != nil {
+				problems = append(problems, fmt.Sprintf("Emulator %q: start_command.path is not an executable file: %v", e.EmulatorId, err))
+			}
+		}
+	}
+	for _, r := range config.Rules {
+		if _, err := s.CreateResolveRule(nil, r); err != nil {
+			report(err)
+		}
+	}
+	for _, g := range config.Groups {
+		if _, err := s.CreateGroup(nil, g); err != nil {
+			report(err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, g := range config.Groups {
+		for _, id := range g.EmulatorIds {
+			if _, exists := s.emulators[id]; !exists {
+				problems = append(problems, fmt.Sprintf("Group %q: emulator %q doesn't exist.", g.GroupId, id))
+			}
+		}
+	}
+	problems = append(problems, s.ambiguousTargets()...)
+	expanded, expandProblems := s.expandEmulators(ids)
+	problems = append(problems, expandProblems...)
+	return expanded, dedupe(problems), dedupe(warnings)
+}
+
+// Returns the values of the emulator that may contain special tokens.
+func tokenValues(emu *emulators.Emulator) []string {
+	var others []string
+	if emu.Rule != nil {
+		others = append(others, emu.Rule.ResolvedHost)
+	}
+	if emu.ReadinessCheck != nil {
+		others = append(others, emu.ReadinessCheck.ResolvedHost)
+	}
+	return commandValues(emu.StartCommand, others...)
+}
+
+// Returns the problems of the special tokens of the emulator: tokens that are
+// not well-formed, e.g. "{port:}" or "{env:HOME".
+func checkTokens(emu *emulators.Emulator) []string {
+	var problems []string
+	for _, value := range tokenValues(emu) {
+		for _, loc := range tokenStartMatcher.FindAllStringSubmatchIndex(value, -1) {
+			m := tokenMatchers[value[loc[2]:loc[3]]].FindStringIndex(value[loc[0]:])
+			if m != nil && m[0] == 0 {
+				continue
+			}
+			token := value[loc[0]:]
+			if end := strings.Index(token, "}"); end >= 0 {
+				token = token[:end+1]
+			}
+			problems = append(problems, fmt.Sprintf("Emulator %q: malformed token %q in %q.", emu.EmulatorId, token, value))
+		}
+	}
+	return problems
+}
+
+// Returns warnings about the environment variables of the env tokens of the
+// emulator that are not set, which are expanded to "".
+func unsetEnvVariables(emu *emulators.Emulator) []string {
+	var warnings []string
+	for _, value := range tokenValues(emu) {
+		for _, submatches := range envMatcher.FindAllStringSubmatch(value, -1) {
+			if _, set := os.LookupEnv(submatches[1]); !set {
+				warnings = append(warnings, fmt.Sprintf("Emulator %q: environment variable %q is not set, and expands to \"\".", emu.EmulatorId, submatches[1]))
+			}
+		}
+	}
+	return warnings
+}
+
+// Returns the targets that several rules match equally well, which Resolve()
+// reports as ambiguous. Each target pattern is probed with one of the
+// targets it matches.
+// REQUIRES s.mu.Lock().
+func (s *server) ambiguousTargets() []string {
+	var ids []string
+	for id := range s.resolveRules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var problems []string
+	reported := make(map[string]bool)
+	for _, id := range ids {
+		for _, pattern := range s.resolveRules[id].TargetPatterns {
+			target, ok := sampleTarget(pattern)
+			if !ok {
+				continue
+			}
+			ambiguous := ambiguousRules(s.ruleIndex.match(target))
+			if ambiguous == nil || reported[strings.Join(ambiguous, " ")] {
+				continue
+			}
+			reported[strings.Join(ambiguous, " ")] = true
+			problems = append(problems, fmt.Sprintf("Target %q, matched by pattern %q of rule %q, matches rules %q equally well.",
+				target, pattern, id, ambiguous))
+		}
+	}
+	return problems
+}
+
+// Returns one of the shortest targets matched by the pattern, or false if it
+// can't be determined.
+func sampleTarget(pattern string) (string, bool) {
+	r, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var b bytes.Buffer
+	if !writeSample(&b, r.Simplify()) {
+		return "", false
+	}
+	target := b.String()
+	if !re.MustCompile(pattern).MatchString(target) {
+		return "", false
+	}
+	return target, true
+}
+
+// Writes one of the shortest strings matched by r to b.
+func writeSample(b *bytes.Buffer, r *syntax.Regexp) bool {
+	switch r.Op {
+	case syntax.OpLiteral:
+		for _, c := range r.Rune {
+			b.WriteRune(c)
+		}
+	case syntax.OpCharClass:
+		if len(r.Rune) == 0 {
+			return false
+		}
+		b.WriteRune(r.Rune[0])
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		b.WriteRune('x')
+	case syntax.OpCapture, syntax.OpPlus:
+		return writeSample(b, r.Sub[0])
+	case syntax.OpRepeat:
+		for i := 0; i < r.Min; i++ {
+			if !writeSample(b, r.Sub[0]) {
+				return false
+			}
+		}
+	case syntax.OpConcat:
+		for _, sub := range r.Sub {
+			if !writeSample(b, sub) {
+				return false
+			}
+		}
+	case syntax.OpAlternate:
+		return writeSample(b, r.Sub[0])
+	case syntax.OpStar, syntax.OpQuest, syntax.OpEmptyMatch,
+		syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		// Matches the empty string.
+	default:
+		return false
+	}
+	return true
+}
+
+// Expands the start commands of the emulators and of their dependencies, in
+// the order they would be started, and checks that the commands can run.
+// Host tokens are expanded to the resolved hosts of the dependencies, if they
+// are known before the dependencies start.
+// REQUIRES s.mu.Lock().
+func (s *server) expandEmulators(ids []string) ([]*emulators.Emulator, []string) {
+	hosts := make(map[string]string)
+	lookupHost := func(id string) (string, error) {
+		if host := hosts[id]; host != "" {
+			return host, nil
+		}
+		return "{host:" + id + "}", nil
+	}
+	var expanded []*emulators.Emulator
+	var problems []string
+	done := make(map[string]bool)
+	for _, id := range ids {
+		order, err := s.startOrder(id)
+		if err != nil {
+			problems = append(problems, grpc.ErrorDesc(err))
+			continue
+		}
+		for _, dep := range order {
+			if done[dep] {
+				continue
+			}
+			done[dep] = true
+			emu := s.emulators[dep]
+			e := proto.Clone(emu.emulator).(*emulators.Emulator)
+			emu.expander.hosts = lookupHost
+			if err := emu.expander.expand(e.StartCommand); err != nil {
+				problems = append(problems, fmt.Sprintf("Emulator %q: %v", dep, err))
+				continue
+			}
+			if template := emu.resolvedHostTemplate; template != "" {
+				if err := emu.expander.expandSpecialTokens(&template); err != nil {
+					problems = append(problems, fmt.Sprintf("Emulator %q: %v", dep, err))
+					continue
+				}
+				e.Rule.ResolvedHost = template
+			}
+			if check := e.ReadinessCheck; check != nil && check.ResolvedHost != "" {
+				if err := emu.expander.expandSpecialTokens(&check.ResolvedHost); err != nil {
+					problems = append(problems, fmt.Sprintf("Emulator %q: %v", dep, err))
+					continue
+				}
+			}
+			hosts[dep] = e.Rule.ResolvedHost
+			for name, port := range emu.expander.ports {
+				if e.Ports == nil {
+					e.Ports = make(map[string]int32)
+				}
+				e.Ports[name] = int32(port)
+			}
+			if err := checkExecutable(e.StartCommand); err != nil {
+				problems = append(problems, fmt.Sprintf("Emulator %q: start_command.path is not an executable file: %v", dep, err))
+			}
+			expanded = append(expanded, e)
+		}
+	}
+	return expanded, problems
+}
+
+// Checks whether the path of the expanded command is an executable file,
+// found like it is when the command runs.
+func checkExecutable(command *emulators.CommandLine) error {
+	path := command.Path
+	if strings.ContainsRune(path, '/') || strings.ContainsRune(path, filepath.Separator) {
+		if !filepath.IsAbs(path) && command.WorkingDir != "" {
+			// Relative to the working directory of the command.
+			path = filepath.Join(command.WorkingDir, path)
+		}
+	}
+	_, err := exec.LookPath(path)
+	return err
+}
+
+// Returns the distinct problems, in order.
+func dedupe(problems []string) []string {
+	var distinct []string
+	seen := make(map[string]bool)
+	for _, p := range problems {
+		if !seen[p] {
+			seen[p] = true
+			distinct = append(distinct, p)
+		}
+	}
+	return distinct
+}
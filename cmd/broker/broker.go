@@ -22,10 +22,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	broker "github.com/GoogleCloudPlatform/cloud-testenv-broker/broker"
 	glog "github.com/golang/glog"
-	jsonpb "github.com/golang/protobuf/jsonpb"
 	proto "github.com/golang/protobuf/proto"
 	emulators "google/emulators"
 	duration_pb "github.com/golang/protobuf/ptypes/duration"
@@ -42,10 +43,31 @@ var (
 		fmt.Sprintf("The server port. If specified as a non-default value, "+
 			"overrides the value of the %s environment variable.",
 			broker.BrokerAddressEnv))
-	// TODO(hbchai): Should we accept multiple config files?
-	configFile = flag.String("config_file", "", "The json config file of the Cloud Broker.")
+	profile      = flag.String("profile", "", "The id of an emulator group in the config file to start when the broker starts.")
+	configFormat = flag.String("config_format", "json", "The format of the config files whose extension is not .json, "+
+		".yaml, .yml, .textproto or .pbtxt: json, yaml or text (the protobuf text format).")
+
+	configFiles stringList
 )
 
+func init() {
+	flag.Var(&configFiles, "config_file", "A config file of the Cloud Broker, or a glob pattern. "+
+		"May be repeated: later files overlay earlier ones. Reloaded only on SIGHUP or a ReloadConfig call: "+
+		"changes to the files are not watched.")
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // Returns the port the broker should serve on.
 func brokerPort() int {
 	if *port != defaultBrokerPort {
@@ -58,6 +80,62 @@ func brokerPort() int {
 	return defaultBrokerPort
 }
 
+// Returns the configuration of the broker, layered from the config files if
+// any were specified.
+func loadConfig() (*emulators.BrokerConfig, error) {
+	config := &emulators.BrokerConfig{}
+	if len(configFiles) > 0 {
+		var err error
+		config, err = broker.LoadConfig(*configFormat, configFiles...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.DefaultEmulatorStartDeadline == nil {
+		config.DefaultEmulatorStartDeadline = &duration_pb.Duration{Seconds: 10}
+	}
+	return config, nil
+}
+
+// Validates the config files, and prints all of their problems and warnings,
+// and the commands the broker would run for the emulators. Returns the exit
+// status, which only problems make non-zero.
+func validate(brokerDir string) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	expanded, problems, warnings := broker.ValidateConfig(config, brokerDir)
+	for _, e := range expanded {
+		command := e.StartCommand
+		fmt.Printf("%s: %s\n", e.EmulatorId, strings.Join(append([]string{command.Path}, command.Args...), " "))
+		if command.WorkingDir != "" {
+			fmt.Printf("  working dir: %s\n", command.WorkingDir)
+		}
+		for name, value := range command.Env {
+			fmt.Printf("  env: %s=%s\n", name, value)
+		}
+		if e.Rule.ResolvedHost != "" {
+			fmt.Printf("  resolved host: %s\n", e.Rule.ResolvedHost)
+		}
+	}
+	if len(warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "Found %d warning(s) in config files %v:\n", len(warnings), configFiles)
+		for _, w := range warnings {
+			fmt.Fprintf(os.Stderr, "  %s\n", w)
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "Found %d problem(s) in config files %v:\n", len(problems), configFiles)
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", p)
+		}
+		return 1
+	}
+	return 0
+}
+
 func main() {
 	flag.Set("alsologtostderr", "true")
 	flag.Parse()
@@ -65,31 +143,42 @@ func main() {
 	if err != nil {
 		glog.Fatalf("Failed to obtain broker directory: %v", err)
 	}
+	switch flag.Arg(0) {
+	case "":
+	case "validate":
+		// Flags may follow the mode too.
+		flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(validate(brokerDir))
+	default:
+		glog.Fatalf("Unknown mode %q: expected none, or validate", flag.Arg(0))
+	}
 	glog.Infof("Broker starting up (%s)...", brokerDir)
 
-	config := emulators.BrokerConfig{DefaultEmulatorStartDeadline: &duration_pb.Duration{Seconds: 10}}
-	if *configFile != "" {
-		// Parse configFile and use it.
-		f, err := os.Open(*configFile)
-		if err != nil {
-			glog.Fatalf("Failed to open config file: %v", err)
-		}
-		defer f.Close()
-		err = jsonpb.Unmarshal(f, &config)
-		if err != nil {
-			glog.Fatalf("Failed to parse config file: %v", err)
-		}
+	config, err := loadConfig()
+	if err != nil {
+		glog.Fatalf("Failed to load config: %v", err)
 	}
-	glog.Infof("Using configuration:\n%s", proto.MarshalTextString(&config))
+	glog.Infof("Using configuration:\n%s", proto.MarshalTextString(config))
 
-	b, err := broker.NewGrpcServer(*host, brokerPort(), brokerDir, &config)
+	b, err := broker.NewGrpcServer(*host, brokerPort(), brokerDir, config)
 	if err != nil {
 		glog.Fatalf("Failed to create broker: %v", err)
 	}
+	if len(configFiles) > 0 {
+		b.SetConfigLoader(loadConfig)
+	}
 	err = b.Start()
 	if err != nil {
 		glog.Fatalf("Failed to start broker: %v", err)
 	}
+	if *profile != "" {
+		glog.Infof("Starting emulator group %q...", *profile)
+		err = b.StartGroup(*profile)
+		if err != nil {
+			b.Shutdown()
+			glog.Fatalf("Failed to start profile: %v", err)
+		}
+	}
 	die := make(chan os.Signal, 1)
 	signal.Notify(die, os.Interrupt, os.Kill)
 	go func() {
@@ -97,6 +186,17 @@ func main() {
 		b.Shutdown()
 		os.Exit(1)
 	}()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			glog.Infof("Reloading config files %v...", configFiles)
+			_, err := b.ReloadConfig(false)
+			if err != nil {
+				glog.Errorf("Failed to reload config: %v", err)
+			}
+		}
+	}()
 	defer b.Shutdown()
 	glog.Infof("Broker listening on %s:%d.", *host, b.Port())
 	b.Wait()
@@ -18,7 +18,7 @@
 SRC=$GOPATH/src
 PTYPES=github.com/golang/protobuf/ptypes
 GOOGLEAPIS=github.com/grpc-ecosystem/grpc-gateway/third_party/googleapis
-PKGMAP=Mgoogle/protobuf/duration.proto=$PTYPES/duration,Mgoogle/protobuf/empty.proto=$PTYPES/empty,Mgoogle/api/annotations.proto=$GOOGLEAPIS/google/api
+PKGMAP=Mgoogle/protobuf/duration.proto=$PTYPES/duration,Mgoogle/protobuf/timestamp.proto=$PTYPES/timestamp,Mgoogle/protobuf/wrappers.proto=$PTYPES/wrappers,Mgoogle/protobuf/empty.proto=$PTYPES/empty,Mgoogle/api/annotations.proto=$GOOGLEAPIS/google/api
 
 rm -f $SRC/google/emulators/broker.*
 